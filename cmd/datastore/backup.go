@@ -0,0 +1,215 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Backup layout:
+//
+//	magic(8) | version(4) | { value }* | trailer
+//
+// Every live key is written once, in key order, as records in the segment
+// format that are neither compressed nor encrypted. A value that fits into a
+// blob chunk is a single put record, and a longer value is a blob record
+// holding its size(8) followed by its chunks, laid out as in a blob file. Both
+// carry the expiration time of the key if it has one. The trailer is a batch
+// record with the number of values in the backup and the sequence number of
+// the snapshot it was taken from.
+const backupMagic = "DSBACKUP"
+
+const backupVersion = 1
+
+// maxBackupRecordSize bounds the records Restore reads, so that a backup
+// cannot make it allocate more: a value takes at most a blob chunk, and the
+// key and the record header share another one.
+const maxBackupRecordSize = 2 * blobChunkSize
+
+// maxBackupKeySize leaves room for a record header with a sequence number and
+// an expiration time next to the key.
+const maxBackupKeySize = blobChunkSize - minRecordSize - 16
+
+var ErrBadBackup = fmt.Errorf("invalid backup")
+
+// Backup writes all live keys with their values to w as of a snapshot taken
+// when it is called. Writes and merges go on meanwhile.
+func (db *Db) Backup(w io.Writer) error {
+	s := db.Snapshot()
+	defer s.Release()
+	return s.Backup(w)
+}
+
+// Backup writes the state of the snapshot to w, as Db.Backup does.
+func (s *Snapshot) Backup(w io.Writer) error {
+	out := bufio.NewWriterSize(w, 2*blobChunkSize)
+	var header [len(backupMagic) + 4]byte
+	copy(header[:], backupMagic)
+	binary.LittleEndian.PutUint32(header[len(backupMagic):], backupVersion)
+	if _, err := out.Write(header[:]); err != nil {
+		return err
+	}
+
+	keys := s.keySet()
+	count := 0
+	key, inclusive := "", true
+	for {
+		next, ok, err := keys.Next(key, inclusive)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		key, inclusive = next, false
+
+		e, err := s.find(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(key) > maxBackupKeySize {
+			return fmt.Errorf("key of %d bytes is too long for a backup", len(key))
+		}
+		switch {
+		case e.kind == recordBlob:
+			err = s.backupBlob(out, e)
+		case len(e.value) > blobChunkSize:
+			err = backupChunks(out, e, int64(len(e.value)), strings.NewReader(e.value))
+		default:
+			_, err = out.Write((&entry{key: key, value: e.value, kind: recordPut, expires: e.expires}).Encode())
+		}
+		if err != nil {
+			return err
+		}
+		count++
+	}
+
+	if _, err := out.Write(batchHeader(count, s.seq)); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// backupBlob copies the value of a blob record to out chunk by chunk.
+func (s *Snapshot) backupBlob(out io.Writer, e entry) error {
+	br, err := s.blobs.open(e)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+	return backupChunks(out, e, br.remaining, br)
+}
+
+// backupChunks writes a blob record for the value of e, which is read from r
+// and holds size bytes, followed by its chunks.
+func backupChunks(out io.Writer, e entry, size int64, r io.Reader) error {
+	var ref [8]byte
+	binary.LittleEndian.PutUint64(ref[:], uint64(size))
+	record := entry{key: e.key, value: string(ref[:]), kind: recordBlob, expires: e.expires}
+	if _, err := out.Write(record.Encode()); err != nil {
+		return err
+	}
+	buf := make([]byte, blobChunkSize)
+	for n := uint64(1); ; n++ {
+		read, err := io.ReadFull(r, buf)
+		if read > 0 {
+			chunk := entry{key: e.key, value: string(buf[:read]), kind: recordPut, seq: n}
+			if _, err := out.Write(chunk.Encode()); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Restore writes the values of a backup read from r to the database, replacing
+// the current values of their keys. Values that expired since the backup was
+// taken are skipped. A backup is only known to be complete once its trailer is
+// read, so the values read before a truncated or corrupted part stay written,
+// and ErrBadBackup is returned. So is a record that is larger than a backup
+// writes, compressed or encrypted.
+func (db *Db) Restore(r io.Reader) error {
+	in := bufio.NewReaderSize(r, 2*blobChunkSize)
+	var header [len(backupMagic) + 4]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil || string(header[:len(backupMagic)]) != backupMagic {
+		return ErrBadBackup
+	}
+	if version := binary.LittleEndian.Uint32(header[len(backupMagic):]); version != backupVersion {
+		return fmt.Errorf("unsupported backup version %d", version)
+	}
+
+	count := 0
+	for {
+		e, err := readBackupEntry(in)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == ErrCorrupted {
+			return ErrBadBackup
+		}
+		if err != nil {
+			return err
+		}
+
+		switch e.kind {
+		case recordPut:
+			if !e.expired(db.now()) {
+				err = db.write(entry{key: e.key, value: e.value, kind: recordPut, expires: e.expires})
+			}
+		case recordBlob:
+			err = db.restoreBlob(in, e)
+		case recordBatch:
+			if e.batchCount() != count {
+				return ErrBadBackup
+			}
+			if _, err := in.ReadByte(); err != io.EOF {
+				return ErrBadBackup
+			}
+			return nil
+		default:
+			return ErrBadBackup
+		}
+		if err == ErrCorrupted {
+			return ErrBadBackup
+		}
+		if err != nil {
+			return err
+		}
+		count++
+	}
+}
+
+// restoreBlob stores the value of a blob record of a backup from the chunks
+// that follow it in.
+func (db *Db) restoreBlob(in *bufio.Reader, e entry) error {
+	if len(e.value) != 8 {
+		return ErrCorrupted
+	}
+	size := int64(binary.LittleEndian.Uint64([]byte(e.value)))
+	br := &blobReader{in: in, key: e.key, remaining: size, next: 1, backup: true}
+	if e.expired(db.now()) {
+		_, err := io.Copy(ioutil.Discard, br)
+		return err
+	}
+	return db.putReader(e.key, br, e.expires)
+}
+
+// readBackupEntry reads a record of a backup. A record larger than
+// maxBackupRecordSize, compressed or encrypted is reported as ErrCorrupted
+// before its value is allocated or inflated.
+func readBackupEntry(in *bufio.Reader) (entry, error) {
+	header, err := in.Peek(headerSize)
+	if err == nil && (binary.LittleEndian.Uint32(header) > maxBackupRecordSize ||
+		header[headerSize-1]&(flagCompressed|flagEncrypted) != 0) {
+		return entry{}, ErrCorrupted
+	}
+	return readEntry(in)
+}
@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_BackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyring := newTestKeyring(t, 1)
+	db, err := NewDb(dir, KB, WithCompression(), WithEncryption(keyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(pairs[0][0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("ttl", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	large := largeValue()
+	if err := db.PutReader("large", strings.NewReader(large)); err != nil {
+		t.Fatal(err)
+	}
+
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+	// Later writes are not part of the backup.
+	if err := db.Put("later", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredDir, err := ioutil.TempDir("", "test-db-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(restoredDir)
+	restored, err := NewDb(restoredDir, KB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if err := restored.Restore(bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs[1:] {
+		if value, err := restored.Get(pair[0]); err != nil || value != pair[1] {
+			t.Errorf("Bad value %q for %s (%v)", value, pair[0], err)
+		}
+	}
+	for _, key := range []string{pairs[0][0], "later"} {
+		if _, err := restored.Get(key); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for %s, got %v", key, err)
+		}
+	}
+	if value, err := restored.Get("large"); err != nil || value != large {
+		t.Errorf("Bad large value of %d bytes (%v)", len(value), err)
+	}
+	e, err := restored.get("ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original, _ := db.get("ttl"); e.expires != original.expires {
+		t.Errorf("Expiration time %d is not kept, expected %d", e.expires, original.expires)
+	}
+
+	t.Run("truncated", func(t *testing.T) {
+		data := backup.Bytes()
+		for _, size := range []int{4, len(data) / 2, len(data) - 1} {
+			if err := restored.Restore(bytes.NewReader(data[:size])); err != ErrBadBackup {
+				t.Errorf("Expected ErrBadBackup for %d bytes, got %v", size, err)
+			}
+		}
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		data := append([]byte(nil), backup.Bytes()...)
+		data[len(data)/2] ^= 0xff
+		if err := restored.Restore(bytes.NewReader(data)); err != ErrBadBackup {
+			t.Errorf("Expected ErrBadBackup, got %v", err)
+		}
+	})
+}
+
+func TestDb_BackupLongValue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-backup-long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// A value written by Put is not a blob, however long it is.
+	large := largeValue()
+	if err := db.PutWithTTL("large", large, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	var backup bytes.Buffer
+	if err := db.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredDir, err := ioutil.TempDir("", "test-db-restore-long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(restoredDir)
+	restored, err := NewDb(restoredDir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if err := restored.Restore(bytes.NewReader(backup.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := restored.Get("large"); err != nil || value != large {
+		t.Errorf("Bad large value of %d bytes (%v)", len(value), err)
+	}
+	e, err := restored.get("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original, _ := db.get("large"); e.expires != original.expires {
+		t.Errorf("Expiration time %d is not kept, expected %d", e.expires, original.expires)
+	}
+}
+
+func TestDb_RestoreRejectsRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-restore-reject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	header := []byte(backupMagic + "\x01\x00\x00\x00")
+	oversized := make([]byte, minRecordSize)
+	binary.LittleEndian.PutUint32(oversized, 1<<31)
+	compressed, _, err := (&entry{key: "key", value: strings.Repeat("v", 100), compressed: true}).encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, _, err := (&entry{key: "key", value: "value"}).encode(newTestKeyring(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], 1000)
+	blob := (&entry{key: "key", value: string(size[:]), kind: recordBlob}).Encode()
+	compressedChunk, _, err := (&entry{key: "key", value: strings.Repeat("v", 1000), seq: 1, compressed: true}).encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, records := range map[string][][]byte{
+		"oversized":        {oversized},
+		"compressed":       {compressed},
+		"encrypted":        {encrypted},
+		"compressed chunk": {blob, compressedChunk},
+	} {
+		data := append([]byte(nil), header...)
+		for _, record := range records {
+			data = append(data, record...)
+		}
+		data = append(data, batchHeader(1, 1)...)
+		if err := db.Restore(bytes.NewReader(data)); err != ErrBadBackup {
+			t.Errorf("%s: expected ErrBadBackup, got %v", name, err)
+		}
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Rejected record is restored: %v", err)
+	}
+}
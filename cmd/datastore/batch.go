@@ -0,0 +1,33 @@
+package datastore
+
+// WriteBatch collects puts and deletes that Db.Write applies atomically: after
+// a crash either all of them are recovered or none is. The zero value is an
+// empty batch ready to use.
+type WriteBatch struct {
+	entries []entry
+	size    int64
+}
+
+func (b *WriteBatch) Put(key, value string) {
+	b.entries = append(b.entries, entry{key: key, value: value, kind: recordPut})
+	b.size += int64(len(value))
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, entry{key: key, kind: recordDelete})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Write commits the batch. The whole batch is written to a single segment
+// with one write, so it never straddles a segment boundary.
+func (db *Db) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	_, err := db.writeData(ChannelData{batch: b.entries}, b.size, nil)
+	return err
+}
@@ -0,0 +1,131 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key0", "value0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b WriteBatch
+	for _, pair := range pairs {
+		b.Put(pair[0], pair[1])
+	}
+	b.Delete("key0")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	sgms := db.getSegments()
+	active := sgms[len(sgms)-1]
+	for _, pair := range pairs {
+		if _, ok := active.index[pair[0]]; !ok {
+			t.Errorf("Batch is split between segments")
+		}
+		value, err := db.Get(pair[0])
+		if err != nil || value != pair[1] {
+			t.Errorf("Bad value for %s: %s (%v)", pair[0], value, err)
+		}
+	}
+	if _, err := db.Get("key0"); err != ErrNotFound {
+		t.Errorf("Key deleted in batch is found: %v", err)
+	}
+
+	t.Run("recovery", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(hintPath(active.outPath)); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, pair := range pairs {
+			value, err := db.Get(pair[0])
+			if err != nil || value != pair[1] {
+				t.Errorf("Bad value for %s: %s (%v)", pair[0], value, err)
+			}
+		}
+	})
+}
+
+func TestDb_WriteTornBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-torn-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key0", "value0"); err != nil {
+		t.Fatal(err)
+	}
+	var b WriteBatch
+	for _, pair := range pairs {
+		b.Put(pair[0], pair[1])
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	sgms := db.getSegments()
+	path := sgms[len(sgms)-1].outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the last record of the batch in half, as a crash in the middle of
+	// the write would.
+	if err := os.Remove(hintPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := (&entry{key: pairs[2][0], value: pairs[2][1], seq: 2}).Encode()
+	if err := os.Truncate(path, stat.Size()-int64(len(last)/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if value, err := db.Get("key0"); err != nil || value != "value0" {
+		t.Errorf("Record before the batch is lost: %s (%v)", value, err)
+	}
+	for _, pair := range pairs {
+		if _, err := db.Get(pair[0]); err != ErrNotFound {
+			t.Errorf("Record %s of a torn batch is recovered: %v", pair[0], err)
+		}
+	}
+	expected := int64(len(batchHeader(len(pairs), 2))) + 3*int64(len(last)) - int64(len(last)/2)
+	if recovered := db.Recovered(); len(recovered) != 1 || recovered[0].Dropped != expected {
+		t.Errorf("Bad recovery report: %v", recovered)
+	}
+}
@@ -0,0 +1,486 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values written with PutReader that are longer than blobChunkSize, or than a
+// segment when segments are smaller, are stored outside of the segments, in a
+// blob file of their own under blobDirName. The blob file is a sequence of
+// ordinary records of the value's key, each holding up to blobChunkSize bytes
+// of the value with the number of the chunk as its sequence number. The
+// segment gets a blob record that references the file:
+//
+//	id(8) | size(8)
+//
+// A blob file is removed once the newest record of its key no longer
+// references it. Merges copy blobs sealed with a key other than the current
+// one to new blob files, so that old keys can be retired.
+const blobChunkSize = 64 * 1024
+
+const blobDirName = "blobs"
+
+const blobRefSize = 16
+
+func blobRef(id, size int64) string {
+	var ref [blobRefSize]byte
+	binary.LittleEndian.PutUint64(ref[:], uint64(id))
+	binary.LittleEndian.PutUint64(ref[8:], uint64(size))
+	return string(ref[:])
+}
+
+// blob returns the id and the size of the blob a blob record references.
+func (e *entry) blob() (int64, int64, error) {
+	if len(e.value) != blobRefSize {
+		return 0, 0, ErrCorrupted
+	}
+	ref := []byte(e.value)
+	return int64(binary.LittleEndian.Uint64(ref)), int64(binary.LittleEndian.Uint64(ref[8:])), nil
+}
+
+// blobStore manages the blob files of a database.
+type blobStore struct {
+	dir      string
+	keyring  *Keyring
+	compress bool
+	sync     bool
+
+	// mutex is held for reading while a blob file is opened and for writing
+	// while unreferenced ones are removed.
+	mutex sync.RWMutex
+	// writing holds the blobs whose records are not written yet.
+	writing map[int64]bool
+	// pins counts the snapshots that may read blobs no longer referenced by
+	// the newest records.
+	pins int
+}
+
+func newBlobStore(db *Db) *blobStore {
+	return &blobStore{
+		dir:      filepath.Join(db.dir, blobDirName),
+		keyring:  db.keyring,
+		compress: db.compress,
+		sync:     db.syncPolicy != SyncNever,
+		writing:  map[int64]bool{},
+	}
+}
+
+func (bs *blobStore) path(id int64) string {
+	return filepath.Join(bs.dir, strconv.FormatInt(id, 10))
+}
+
+// create opens a new blob file and keeps it until done is called.
+func (bs *blobStore) create() (int64, *os.File, error) {
+	if err := os.MkdirAll(bs.dir, os.ModePerm); err != nil {
+		return 0, nil, err
+	}
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	for {
+		id := time.Now().UnixNano()
+		file, err := os.OpenFile(bs.path(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		bs.writing[id] = true
+		return id, file, nil
+	}
+}
+
+func (bs *blobStore) done(id int64) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	delete(bs.writing, id)
+}
+
+// write stores key's value made of head followed by the rest of r in a new
+// blob file. The blob is kept until done is called.
+func (bs *blobStore) write(key string, head []byte, r io.Reader) (int64, int64, error) {
+	id, file, err := bs.create()
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := bs.writeChunks(file, key, head, r)
+	if err == nil && bs.sync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(bs.path(id))
+		bs.done(id)
+		return 0, 0, err
+	}
+	return id, size, nil
+}
+
+func (bs *blobStore) writeChunks(file *os.File, key string, head []byte, r io.Reader) (int64, error) {
+	out := bufio.NewWriterSize(file, 2*blobChunkSize)
+	buf := make([]byte, blobChunkSize)
+	chunk := head
+	var size int64
+	for n := uint64(1); len(chunk) > 0; n++ {
+		e := entry{key: key, value: string(chunk), kind: recordPut, seq: n, compressed: bs.compress}
+		record, _, err := e.encode(bs.keyring)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := out.Write(record); err != nil {
+			return 0, err
+		}
+		size += int64(len(chunk))
+
+		read, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		chunk = buf[:read]
+	}
+	return size, out.Flush()
+}
+
+// open opens the blob a blob record of key references.
+func (bs *blobStore) open(e entry) (*blobReader, error) {
+	id, size, err := e.blob()
+	if err != nil {
+		return nil, err
+	}
+	bs.mutex.RLock()
+	file, err := os.Open(bs.path(id))
+	bs.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{
+		file:      file,
+		in:        bufio.NewReaderSize(file, 2*blobChunkSize),
+		key:       e.key,
+		keyring:   bs.keyring,
+		remaining: size,
+		next:      1,
+	}, nil
+}
+
+// stale reports whether the blob a blob record references is not sealed with
+// the current key, which is no key at all without a keyring. A missing blob is
+// left alone.
+func (bs *blobStore) stale(e entry) (bool, error) {
+	id, _, err := e.blob()
+	if err != nil {
+		return false, err
+	}
+	bs.mutex.RLock()
+	file, err := os.Open(bs.path(id))
+	bs.mutex.RUnlock()
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	first, err := readEntry(bufio.NewReader(file))
+	if err != nil {
+		return false, err
+	}
+	var current uint32
+	if bs.keyring != nil {
+		current = bs.keyring.Current()
+	}
+	return first.keyID != current, nil
+}
+
+// rewrite copies the blob a blob record references to a new blob file sealed
+// with the current key, and returns the record referencing the copy. The copy
+// is kept until done is called.
+func (bs *blobStore) rewrite(e entry) (entry, int64, error) {
+	br, err := bs.open(e)
+	if err != nil {
+		return entry{}, 0, err
+	}
+	defer br.Close()
+	head := make([]byte, blobChunkSize)
+	n, err := io.ReadFull(br, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return entry{}, 0, err
+	}
+	id, size, err := bs.write(e.key, head[:n], br)
+	if err != nil {
+		return entry{}, 0, err
+	}
+	e.value = blobRef(id, size)
+	return e, id, nil
+}
+
+// read returns the whole value of a blob record.
+func (bs *blobStore) read(e entry) (string, error) {
+	br, err := bs.open(e)
+	if err != nil {
+		return "", err
+	}
+	defer br.Close()
+	var value strings.Builder
+	value.Grow(int(br.remaining))
+	if _, err := io.Copy(&value, br); err != nil {
+		return "", err
+	}
+	return value.String(), nil
+}
+
+func (bs *blobStore) pin() {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	bs.pins++
+}
+
+func (bs *blobStore) unpin() {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	bs.pins--
+}
+
+// collect removes the blob files that newest returns no blob record for. It
+// does nothing while snapshots are open.
+func (bs *blobStore) collect(newest func(key string) (entry, error)) error {
+	files, err := ioutil.ReadDir(bs.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	if bs.pins > 0 {
+		return nil
+	}
+	for _, file := range files {
+		id, err := strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil || bs.writing[id] {
+			continue
+		}
+		path := bs.path(id)
+		live, err := bs.referenced(id, newest)
+		if err != nil {
+			return err
+		}
+		if !live {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// referenced reports whether the newest record of the key stored in blob id
+// references it. A blob whose first chunk cannot be read is never referenced,
+// as a crash left it behind while it was being written.
+func (bs *blobStore) referenced(id int64, newest func(key string) (entry, error)) (bool, error) {
+	file, err := os.Open(bs.path(id))
+	if err != nil {
+		return false, err
+	}
+	first, err := readEntry(bufio.NewReader(file))
+	file.Close()
+	if err != nil {
+		log.Printf("Blob %d: %s", id, err)
+		return false, nil
+	}
+
+	e, err := newest(first.key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil || e.kind != recordBlob {
+		return false, err
+	}
+	ref, _, err := e.blob()
+	return ref == id, err
+}
+
+// blobReader reads the chunks of a blob file in order.
+type blobReader struct {
+	file      *os.File
+	in        *bufio.Reader
+	key       string
+	keyring   *Keyring
+	remaining int64
+	next      uint64
+	chunk     string
+	// backup marks chunks read from a backup, which readBackupEntry bounds.
+	backup bool
+}
+
+func (br *blobReader) Read(p []byte) (int, error) {
+	for br.chunk == "" {
+		if br.remaining == 0 {
+			return 0, io.EOF
+		}
+		read := readEntry
+		if br.backup {
+			read = readBackupEntry
+		}
+		e, err := read(br.in)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, ErrCorrupted
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := e.decrypt(br.keyring); err != nil {
+			return 0, err
+		}
+		if e.key != br.key || e.seq != br.next || e.value == "" || int64(len(e.value)) > br.remaining {
+			return 0, ErrCorrupted
+		}
+		br.next++
+		br.remaining -= int64(len(e.value))
+		br.chunk = e.value
+	}
+	n := copy(p, br.chunk)
+	br.chunk = br.chunk[n:]
+	return n, nil
+}
+
+func (br *blobReader) Close() error {
+	return br.file.Close()
+}
+
+// ValueReader reads a value returned by Db.GetReader.
+type ValueReader struct {
+	io.Reader
+	size    int64
+	version uint64
+	closer  io.Closer
+}
+
+// Size returns the length of the value.
+func (vr *ValueReader) Size() int64 {
+	return vr.size
+}
+
+// Version returns the version of the value, as GetVersion does.
+func (vr *ValueReader) Version() uint64 {
+	return vr.version
+}
+
+// Close releases the files held by the reader.
+func (vr *ValueReader) Close() error {
+	if vr.closer == nil {
+		return nil
+	}
+	return vr.closer.Close()
+}
+
+// blobThreshold returns the length from which PutReader stores values in
+// blobs.
+func (db *Db) blobThreshold() int64 {
+	if db.segmentSize > 0 && db.segmentSize < blobChunkSize {
+		return db.segmentSize
+	}
+	return blobChunkSize
+}
+
+// PutReader stores the value read from r until io.EOF under key. A value
+// longer than a blob chunk or a segment is never held in memory as a whole:
+// it is written in chunks to a blob file, so it may also be larger than a
+// segment.
+func (db *Db) PutReader(key string, r io.Reader) error {
+	return db.putReader(key, r, 0)
+}
+
+// putReader stores a value as PutReader does. The value expires at expires
+// unless it is zero.
+func (db *Db) putReader(key string, r io.Reader, expires int64) error {
+	head := make([]byte, db.blobThreshold())
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return db.write(entry{key: key, value: string(head[:n]), kind: recordPut, expires: expires})
+	}
+	if err != nil {
+		return err
+	}
+
+	id, size, err := db.blobs.write(key, head, r)
+	if err != nil {
+		return err
+	}
+	defer db.blobs.done(id)
+	err = db.write(entry{key: key, value: blobRef(id, size), kind: recordBlob, expires: expires})
+	if err != nil {
+		os.Remove(db.blobs.path(id))
+	}
+	return err
+}
+
+// GetReader returns a reader of the value of key that streams values stored
+// by PutReader from disk. It has to be closed.
+func (db *Db) GetReader(key string) (*ValueReader, error) {
+	var missing uint64
+	read := db.get
+	for {
+		e, err := read(key)
+		if err != nil {
+			return nil, err
+		}
+		if e.kind != recordBlob {
+			return &ValueReader{
+				Reader:  strings.NewReader(e.value),
+				size:    int64(len(e.value)),
+				version: e.seq,
+			}, nil
+		}
+
+		br, err := db.blobs.open(e)
+		// The blob is removed once the key is written again or a merge copies
+		// it, so the newest record has to be looked up once more, past the
+		// cache, which may still hold the record read.
+		if os.IsNotExist(err) && e.seq != missing {
+			missing, read = e.seq, db.readNewest
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &ValueReader{
+			Reader:  br,
+			size:    br.remaining,
+			version: e.seq,
+			closer:  br,
+		}, nil
+	}
+}
+
+// GetWriter copies the value of key to w without holding it in memory when it
+// was stored by PutReader.
+func (db *Db) GetWriter(key string, w io.Writer) error {
+	vr, err := db.GetReader(key)
+	if err != nil {
+		return err
+	}
+	defer vr.Close()
+	_, err = io.Copy(w, vr)
+	return err
+}
+
+// collectBlobs removes the blob files no longer referenced by the newest record
+// of their keys.
+func (db *Db) collectBlobs() error {
+	return db.blobs.collect(db.readNewest)
+}
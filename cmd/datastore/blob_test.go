@@ -0,0 +1,247 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// largeValue returns a value spanning several blob chunks.
+func largeValue() string {
+	var value strings.Builder
+	for i := 0; value.Len() < 3*blobChunkSize+17; i++ {
+		value.WriteString(createUniqueString(i))
+	}
+	return value.String()
+}
+
+func blobFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, blobDirName, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDb_PutReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-put-reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyring := newTestKeyring(t, 1)
+	db, err := NewDb(dir, KB, WithCompression(), WithEncryption(keyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	value := largeValue()
+	if err := db.PutReader("large", strings.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader("small", strings.NewReader("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T) {
+		var out bytes.Buffer
+		if err := db.GetWriter("large", &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != value {
+			t.Errorf("Bad streamed value of %d bytes", out.Len())
+		}
+		if got, err := db.Get("large"); err != nil || got != value {
+			t.Errorf("Bad value of %d bytes (%v)", len(got), err)
+		}
+		if got, err := db.Get("small"); err != nil || got != "value" {
+			t.Errorf("Bad small value %q (%v)", got, err)
+		}
+		for _, sgm := range db.getSegments() {
+			if sgm.offset() > KB {
+				t.Errorf("Segment %s holds %d bytes", sgm.outPath, sgm.offset())
+			}
+		}
+	}
+
+	t.Run("chunked", func(t *testing.T) {
+		check(t)
+		if files := blobFiles(t, dir); len(files) != 1 {
+			t.Fatalf("Expected a single blob file, got %v", files)
+		}
+		vr, err := db.GetReader("large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vr.Close()
+		if vr.Size() != int64(len(value)) {
+			t.Errorf("Bad size %d", vr.Size())
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = NewDb(dir, KB, WithEncryption(keyring)); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		snapshot := db.Snapshot()
+		if err := db.Put("large", "replaced"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.collectBlobs(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := snapshot.Get("large"); err != nil || got != value {
+			t.Errorf("Bad snapshot value of %d bytes (%v)", len(got), err)
+		}
+		snapshot.Release()
+
+		if err := db.collectBlobs(); err != nil {
+			t.Fatal(err)
+		}
+		if files := blobFiles(t, dir); len(files) != 0 {
+			t.Errorf("Unreferenced blobs are kept: %v", files)
+		}
+		if got, err := db.Get("large"); err != nil || got != "replaced" {
+			t.Errorf("Bad value %q (%v)", got, err)
+		}
+	})
+}
+
+func TestDb_PutReaderCorrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-put-reader-corrupted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutReader("large", strings.NewReader(largeValue())); err != nil {
+		t.Fatal(err)
+	}
+	files := blobFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("Expected a single blob file, got %v", files)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(files[0], data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.GetWriter("large", ioutil.Discard); err != ErrCorrupted {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+}
+
+func TestDb_PutReaderLargerThanSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-put-reader-segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, KB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := strings.Repeat("v", 4*KB)
+	if err := db.PutReader("large", strings.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	if files := blobFiles(t, dir); len(files) != 1 {
+		t.Errorf("Expected a single blob file, got %v", files)
+	}
+	for _, sgm := range db.getSegments() {
+		if sgm.offset() > KB {
+			t.Errorf("Segment %s holds %d bytes", sgm.outPath, sgm.offset())
+		}
+	}
+	if got, err := db.Get("large"); err != nil || got != value {
+		t.Errorf("Bad value of %d bytes (%v)", len(got), err)
+	}
+}
+
+func TestDb_BlobKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-blob-rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, KB, WithEncryption(newTestKeyring(t, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := largeValue()
+	if err := db.PutReader("large", strings.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	original := blobFiles(t, dir)
+
+	db, err = NewDb(dir, KB, WithEncryption(newTestKeyring(t, 1, 2)), WithCache(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cached record references the blob the merge replaces.
+	if got, err := db.Get("large"); err != nil || got != value {
+		t.Fatalf("Bad value of %d bytes (%v)", len(got), err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.cache.get("large"); ok {
+		t.Error("Record of a copied blob is still cached")
+	}
+	if got, err := db.Get("large"); err != nil || got != value {
+		t.Errorf("Bad value of %d bytes after the merge (%v)", len(got), err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := blobFiles(t, dir)
+	if len(files) != 1 || len(original) != 1 || files[0] == original[0] {
+		t.Fatalf("Expected the blob to be rewritten, got %v from %v", files, original)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, err := readEntry(bufio.NewReader(bytes.NewReader(data))); err != nil || first.keyID != 2 {
+		t.Errorf("Blob is sealed with key %d (%v)", first.keyID, err)
+	}
+
+	db, err = NewDb(dir, KB, WithEncryption(newTestKeyring(t, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get("large"); err != nil || got != value {
+		t.Errorf("Bad value of %d bytes (%v)", len(got), err)
+	}
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io/ioutil"
+	"strings"
+)
+
+// Bloom filter file layout:
+//
+//	bits(8)* | hashes(4) | segmentSize(8) | crc(4)
+//
+// A sealed segment keeps a Bloom filter of its keys next to it, so lookups of
+// keys it does not hold rarely have to consult its index. Like a hint file,
+// the filter is pinned to the exact segment file it was built from.
+const bloomSuffix = ".bloom"
+
+const bloomFooterSize = 16
+
+// bloomBitsPerKey gives a false positive rate of about 1% with bloomHashes
+// hash functions.
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+var errBadBloom = fmt.Errorf("invalid bloom filter file")
+
+func bloomPath(segmentPath string) string {
+	return segmentPath + bloomSuffix
+}
+
+func isBloomFile(name string) bool {
+	return strings.Contains(name, bloomSuffix)
+}
+
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint32
+}
+
+func newBloomFilter(keys int) *bloomFilter {
+	words := (keys*bloomBitsPerKey + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloomFilter{bits: make([]uint64, words), hashes: bloomHashes}
+}
+
+// locations derives the bit positions of key by double hashing.
+func (bf *bloomFilter) locations(key string, fn func(bit uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	m := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < uint64(bf.hashes); i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
+
+func (bf *bloomFilter) add(key string) {
+	bf.locations(key, func(bit uint64) {
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+// mayContain reports false only for keys that were never added.
+func (bf *bloomFilter) mayContain(key string) bool {
+	found := true
+	bf.locations(key, func(bit uint64) {
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// buildBloom fills the Bloom filter of a sealed segment from its index and
+// persists it.
+func (sgm *Segment) buildBloom() error {
+	sgm.mutex.Lock()
+	keys := len(sgm.index)
+	if sgm.index == nil {
+		keys = sgm.sparse.count
+	}
+	segmentSize := sgm.outOffset
+	sgm.mutex.Unlock()
+
+	bf := newBloomFilter(keys)
+	err := sgm.forEach(func(key string, pos recordPosition) bool {
+		bf.add(key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	sgm.mutex.Lock()
+	sgm.bloom = bf
+	sgm.mutex.Unlock()
+
+	data := make([]byte, len(bf.bits)*8+bloomFooterSize)
+	for i, word := range bf.bits {
+		binary.LittleEndian.PutUint64(data[i*8:], word)
+	}
+	footer := data[len(bf.bits)*8:]
+	binary.LittleEndian.PutUint32(footer, bf.hashes)
+	binary.LittleEndian.PutUint64(footer[4:], uint64(segmentSize))
+	binary.LittleEndian.PutUint32(footer[12:], crc32.ChecksumIEEE(data[:len(data)-4]))
+
+	return writeFileDurably(bloomPath(sgm.outPath), data)
+}
+
+// loadBloom reads the Bloom filter of a sealed segment. The segment is left
+// without a filter when the file is missing or does not match the segment.
+func (sgm *Segment) loadBloom() error {
+	data, err := ioutil.ReadFile(bloomPath(sgm.outPath))
+	if err != nil {
+		return err
+	}
+	if len(data) < bloomFooterSize+8 || (len(data)-bloomFooterSize)%8 != 0 {
+		return errBadBloom
+	}
+	footer := data[len(data)-bloomFooterSize:]
+	if binary.LittleEndian.Uint32(footer[12:]) != crc32.ChecksumIEEE(data[:len(data)-4]) {
+		return errBadBloom
+	}
+	hashes := binary.LittleEndian.Uint32(footer)
+	segmentSize := int64(binary.LittleEndian.Uint64(footer[4:]))
+	if hashes == 0 {
+		return errBadBloom
+	}
+
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+	if segmentSize != sgm.outOffset {
+		return fmt.Errorf("%w: segment size %d does not match %d", errBadBloom, sgm.outOffset, segmentSize)
+	}
+	bf := &bloomFilter{bits: make([]uint64, (len(data)-bloomFooterSize)/8), hashes: hashes}
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	sgm.bloom = bf
+	return nil
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const keys = 10000
+	bf := newBloomFilter(keys)
+	for i := 0; i < keys; i++ {
+		bf.add(createUniqueString(i))
+	}
+	for i := 0; i < keys; i++ {
+		if !bf.mayContain(createUniqueString(i)) {
+			t.Fatalf("Key %d is missing from the filter", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := keys; i < 2*keys; i++ {
+		if bf.mayContain(createUniqueString(i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / keys; rate > 0.03 {
+		t.Errorf("False positive rate %f is too high", rate)
+	}
+}
+
+func TestBloom_Recovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sgm := db.segments[len(db.segments)-1]
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sgm.bloom == nil {
+		t.Fatal("Sealed segment has no bloom filter")
+	}
+
+	t.Run("persisted", func(t *testing.T) {
+		loaded, err := NewSegment(false, sgm.outPath, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer loaded.Close()
+		if err := loaded.loadHint(); err != nil {
+			t.Fatal(err)
+		}
+		if err := loaded.loadBloom(); err != nil {
+			t.Fatal(err)
+		}
+		for _, pair := range pairs {
+			if value, err := loaded.Get(pair[0]); err != nil || value != pair[1] {
+				t.Errorf("Bad value for %s: %s (%v)", pair[0], value, err)
+			}
+		}
+		if _, err := loaded.Get("absent"); err != ErrNotFound {
+			t.Errorf("Absent key is found: %v", err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		stale, err := NewSegment(false, sgm.outPath, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stale.Close()
+		if err := stale.loadBloom(); !errors.Is(err, errBadBloom) {
+			t.Errorf("Bloom filter of a different segment size is loaded: %v", err)
+		}
+	})
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.segments[0].bloom == nil {
+		t.Error("Bloom filter is not loaded on recovery")
+	}
+}
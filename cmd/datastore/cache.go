@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// cacheEntryOverhead approximates the memory a cached entry takes besides its
+// key and value.
+const cacheEntryOverhead = 128
+
+const cacheStripes = 64
+
+// valueCache is an LRU cache of the newest live records of keys, bounded by
+// the total size of their keys and values.
+//
+// A record read from the segments is only cached when no write to its key
+// was applied during the read. Writes bump the epoch of the stripe their key
+// falls into, and fills carrying an older epoch are dropped. Merges move
+// records between segments, which leaves cached records valid, but also copy
+// blobs to seal them with the current key. They invalidate the keys of those
+// blobs, as the cached records reference the originals.
+type valueCache struct {
+	// hits and misses come first to keep them aligned for atomic access.
+	hits, misses int64
+
+	mutex    sync.Mutex
+	capacity int64
+	size     int64
+	items    map[string]*list.Element
+	lru      *list.List
+	epochs   [cacheStripes]uint64
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func cacheEntrySize(e *entry) int64 {
+	return int64(len(e.key) + len(e.value) + cacheEntryOverhead)
+}
+
+func cacheStripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % cacheStripes)
+}
+
+func (c *valueCache) get(key string) (entry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return entry{}, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	c.lru.MoveToFront(elem)
+	return *elem.Value.(*entry), true
+}
+
+// epoch returns the epoch a fill of key has to carry.
+func (c *valueCache) epoch(key string) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.epochs[cacheStripe(key)]
+}
+
+// add caches e unless a write to its key was applied since epoch was taken.
+func (c *valueCache) add(e entry, epoch uint64) {
+	size := cacheEntrySize(&e)
+	if size > c.capacity {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.epochs[cacheStripe(e.key)] != epoch {
+		return
+	}
+	if elem, ok := c.items[e.key]; ok {
+		c.remove(elem)
+	}
+	c.items[e.key] = c.lru.PushFront(&e)
+	c.size += size
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops key after a write to it.
+func (c *valueCache) invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.epochs[cacheStripe(key)]++
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *valueCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.items, e.key)
+	c.size -= cacheEntrySize(e)
+}
+
+func (c *valueCache) bytes() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValueCache_Evict(t *testing.T) {
+	entrySize := cacheEntrySize(&entry{key: "key1", value: "value1"})
+	c := newValueCache(2 * entrySize)
+
+	for _, key := range []string{"key1", "key2"} {
+		c.add(entry{key: key, value: "value" + key[3:]}, c.epoch(key))
+	}
+	if _, ok := c.get("key1"); !ok {
+		t.Fatal("key1 is not cached")
+	}
+	c.add(entry{key: "key3", value: "value3"}, c.epoch("key3"))
+
+	if _, ok := c.get("key2"); ok {
+		t.Error("Least recently used key is not evicted")
+	}
+	for _, key := range []string{"key1", "key3"} {
+		if e, ok := c.get(key); !ok || e.value != "value"+key[3:] {
+			t.Errorf("Bad cached value for %s: %s", key, e.value)
+		}
+	}
+	if c.bytes() != 2*entrySize {
+		t.Errorf("Unexpected cache size %d", c.bytes())
+	}
+
+	c.add(entry{key: "big", value: strings.Repeat("v", int(2*entrySize))}, c.epoch("big"))
+	if _, ok := c.get("big"); ok {
+		t.Error("Value larger than the cache is cached")
+	}
+}
+
+func TestValueCache_StaleFill(t *testing.T) {
+	c := newValueCache(1024)
+
+	epoch := c.epoch("key")
+	c.invalidate("key")
+	c.add(entry{key: "key", value: "old"}, epoch)
+	if _, ok := c.get("key"); ok {
+		t.Error("Value read before a write is cached")
+	}
+}
+
+func TestDb_Cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize, WithCache(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if value, err := db.Get("key"); err != nil || value != "value1" {
+			t.Fatalf("Bad value: %s (%v)", value, err)
+		}
+	}
+	if stats := db.Stats(); stats.CacheHits != 2 || stats.CacheMisses != 1 || stats.CacheBytes == 0 {
+		t.Errorf("Unexpected cache stats: %+v", stats)
+	}
+
+	if err := db.Put("key", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value2" {
+		t.Errorf("Cached value is not invalidated by Put: %s (%v)", value, err)
+	}
+
+	batch := new(WriteBatch)
+	batch.Put("key", "value3")
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value3" {
+		t.Errorf("Cached value is not invalidated by a batch: %s (%v)", value, err)
+	}
+
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Cached value is not invalidated by Delete: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package datastore
+
+import "fmt"
+
+// SegmentInfo describes a sealed segment to a CompactionPolicy.
+type SegmentInfo struct {
+	Name string
+	// Size is the number of bytes in the segment file.
+	Size int64
+	// LiveSize is the number of bytes taken by records that are neither
+	// overwritten in the same segment nor shadowed by a newer one.
+	LiveSize int64
+}
+
+// GarbageRatio returns the share of the segment taken by dead records.
+func (si SegmentInfo) GarbageRatio() float64 {
+	if si.Size == 0 {
+		return 0
+	}
+	return float64(si.Size-si.LiveSize) / float64(si.Size)
+}
+
+// CompactionPolicy decides which sealed segments are merged together.
+type CompactionPolicy interface {
+	// Pick receives the sealed segments ordered from oldest to newest and
+	// returns the half-open range [from, to) of them to merge into a single
+	// segment. An empty range means that there is nothing to compact, and
+	// a range reaching past the sealed segments fails the compaction pass.
+	Pick(segments []SegmentInfo) (from, to int)
+}
+
+// SizeTieredPolicy merges runs of neighbouring segments of similar size, so
+// that segment sizes grow in tiers and every record is rewritten only a
+// logarithmic number of times.
+type SizeTieredPolicy struct {
+	// MinSegments is the smallest run of similar segments worth merging.
+	MinSegments int
+	// MaxSegments limits the number of segments merged at once, 0 means no
+	// limit.
+	MaxSegments int
+	// BucketLow and BucketHigh bound the size of a segment relative to the
+	// average size of the run it joins.
+	BucketLow, BucketHigh float64
+}
+
+// DefaultCompactionPolicy is used by NewDb unless WithCompactionPolicy is
+// given.
+var DefaultCompactionPolicy CompactionPolicy = SizeTieredPolicy{
+	MinSegments: 2,
+	BucketLow:   0.5,
+	BucketHigh:  1.5,
+}
+
+func (p SizeTieredPolicy) Pick(segments []SegmentInfo) (int, int) {
+	minSegments := p.MinSegments
+	if minSegments < 1 {
+		minSegments = 1
+	}
+
+	for from := 0; from < len(segments); {
+		to := from + 1
+		total := segments[from].Size
+		for to < len(segments) && (p.MaxSegments == 0 || to-from < p.MaxSegments) {
+			avg := float64(total) / float64(to-from)
+			size := float64(segments[to].Size)
+			if size < avg*p.BucketLow || size > avg*p.BucketHigh {
+				break
+			}
+			total += segments[to].Size
+			to++
+		}
+		if to-from >= minSegments {
+			return from, to
+		}
+		from = to
+	}
+	return 0, 0
+}
+
+// GarbageRatioPolicy rewrites runs of neighbouring segments in which dead
+// records take at least Threshold of the space. Threshold has to be positive.
+type GarbageRatioPolicy struct {
+	Threshold float64
+	// MaxSegments limits the number of segments merged at once, 0 means no
+	// limit.
+	MaxSegments int
+}
+
+func (p GarbageRatioPolicy) Pick(segments []SegmentInfo) (int, int) {
+	for from := range segments {
+		if segments[from].Size == 0 || segments[from].GarbageRatio() < p.Threshold {
+			continue
+		}
+		to := from + 1
+		for to < len(segments) && (p.MaxSegments == 0 || to-from < p.MaxSegments) {
+			if segments[to].Size == 0 || segments[to].GarbageRatio() < p.Threshold {
+				break
+			}
+			to++
+		}
+		return from, to
+	}
+	return 0, 0
+}
+
+// checkPolicy rejects the settings of the built-in policies that would pick
+// segments without any dead records.
+func checkPolicy(policy CompactionPolicy) error {
+	var threshold float64
+	switch p := policy.(type) {
+	case GarbageRatioPolicy:
+		threshold = p.Threshold
+	case *GarbageRatioPolicy:
+		threshold = p.Threshold
+	default:
+		return nil
+	}
+	if threshold <= 0 {
+		return fmt.Errorf("garbage ratio threshold has to be positive, got %g", threshold)
+	}
+	return nil
+}
+
+// CompactionTrigger tells when the compaction worker looks for segments to
+// merge, which it considers whenever a new segment is started. A zero field
+// is ignored, and a zero trigger lets the policy pick segments every time.
+type CompactionTrigger struct {
+	// MinSegments is the number of sealed segments that starts a pass.
+	MinSegments int
+	// GarbageRatio is the share of dead records in the sealed segments that
+	// starts a pass.
+	GarbageRatio float64
+}
+
+// reachedBy reports whether count sealed segments call for a compaction pass
+// whatever their live sizes.
+func (t CompactionTrigger) reachedBy(count int) bool {
+	if t.MinSegments <= 0 && t.GarbageRatio <= 0 {
+		return true
+	}
+	return t.MinSegments > 0 && count >= t.MinSegments
+}
+
+// reached reports whether the sealed segments described by infos call for a
+// compaction pass.
+func (t CompactionTrigger) reached(infos []SegmentInfo) bool {
+	if t.reachedBy(len(infos)) {
+		return true
+	}
+	var size, live int64
+	for _, info := range infos {
+		size += info.Size
+		live += info.LiveSize
+	}
+	return t.GarbageRatio > 0 && size > 0 && float64(size-live)/float64(size) >= t.GarbageRatio
+}
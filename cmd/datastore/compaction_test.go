@@ -0,0 +1,466 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSizeTieredPolicy_Pick(t *testing.T) {
+	policy := SizeTieredPolicy{MinSegments: 3, BucketLow: 0.5, BucketHigh: 1.5}
+	sizes := func(sizes ...int64) []SegmentInfo {
+		infos := make([]SegmentInfo, len(sizes))
+		for i, size := range sizes {
+			infos[i] = SegmentInfo{Size: size, LiveSize: size}
+		}
+		return infos
+	}
+
+	for _, tc := range []struct {
+		sizes    []SegmentInfo
+		from, to int
+	}{
+		{sizes(100, 100), 0, 0},
+		{sizes(100, 100, 100), 0, 3},
+		{sizes(400, 100, 110, 90, 100), 1, 5},
+		{sizes(400, 100, 110, 400, 100), 0, 0},
+	} {
+		from, to := policy.Pick(tc.sizes)
+		if from != tc.from || to != tc.to {
+			t.Errorf("Bad range for %v: expected [%d, %d), got [%d, %d)", tc.sizes, tc.from, tc.to, from, to)
+		}
+	}
+
+	policy.MaxSegments = 2
+	if from, to := policy.Pick(sizes(100, 100, 100)); from != 0 || to != 0 {
+		t.Errorf("MaxSegments is ignored: got [%d, %d)", from, to)
+	}
+}
+
+func TestGarbageRatioPolicy_Pick(t *testing.T) {
+	policy := GarbageRatioPolicy{Threshold: 0.5}
+	from, to := policy.Pick([]SegmentInfo{
+		{Size: 100, LiveSize: 100},
+		{Size: 100, LiveSize: 20},
+		{Size: 100, LiveSize: 50},
+		{Size: 100, LiveSize: 90},
+		{Size: 100, LiveSize: 0},
+	})
+	if from != 1 || to != 3 {
+		t.Errorf("Bad range: expected [1, 3), got [%d, %d)", from, to)
+	}
+}
+
+func TestMergedName(t *testing.T) {
+	for name, merged := range map[string]string{
+		"100":       "100-1",
+		"100-1":     "100-2",
+		"100-1-1-1": "100-2",
+		"100-9":     "100-10",
+	} {
+		if got := mergedName(name); got != merged {
+			t.Errorf("Merged name of %s: expected %s, got %s", name, merged, got)
+		}
+	}
+}
+
+func TestDb_CompactionProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-compaction-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewDb(dir, 100, WithCompactionPolicy(GarbageRatioPolicy{})); err == nil {
+		t.Fatal("Policy without a garbage threshold is accepted")
+	}
+
+	// Both policies pick single segments, which must not be rewritten once
+	// they hold no dead records.
+	for _, policy := range []CompactionPolicy{
+		SizeTieredPolicy{MinSegments: 1, BucketLow: 0.5, BucketHigh: 1.5},
+		GarbageRatioPolicy{Threshold: 0.01},
+	} {
+		db, err := NewDb(dir, 100, WithCompactionPolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := db.Put(createUniqueString(i%3), createUniqueString(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The first pass may still rewrite records shadowed by the active
+		// segment, the second one has nothing left to do.
+		db.compactor.waitIdle()
+		db.startCompaction()
+		db.compactor.waitIdle()
+		merges := db.Stats().Merges
+		db.startCompaction()
+		db.compactor.waitIdle()
+		if stats := db.Stats(); stats.Merges != merges || stats.CompactionErrors != 0 {
+			t.Errorf("%T: a pass without dead records merged %d times (%v)", policy, stats.Merges-merges, stats.CompactionError)
+		}
+		for _, name := range segmentFileNames(db) {
+			if len(name) > len("1234567890123456789-99") {
+				t.Errorf("%T: merged name %s keeps growing", policy, name)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// pickFunc is a CompactionPolicy made of a function.
+type pickFunc func(segments []SegmentInfo) (int, int)
+
+func (p pickFunc) Pick(segments []SegmentInfo) (int, int) {
+	return p(segments)
+}
+
+func TestDb_CompactionBadPick(t *testing.T) {
+	for name, policy := range map[string]pickFunc{
+		"past the sealed segments": func(s []SegmentInfo) (int, int) { return 0, len(s) + 1 },
+		"negative":                 func(s []SegmentInfo) (int, int) { return -1, len(s) },
+		"reversed":                 func(s []SegmentInfo) (int, int) { return len(s), len(s) - 1 },
+	} {
+		dir, err := ioutil.TempDir("", "test-db-compaction-bad-pick")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		db, err := NewDb(dir, 100, WithCompactionPolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := db.Put(createUniqueString(i%3), createUniqueString(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.compactor.waitIdle()
+		if stats := db.Stats(); stats.Merges != 0 || stats.CompactionErrors == 0 {
+			t.Errorf("%s: %d merges, %d errors", name, stats.Merges, stats.CompactionErrors)
+		}
+		for i := 7; i < 10; i++ {
+			if value, err := db.Get(createUniqueString(i % 3)); err != nil || value != createUniqueString(i) {
+				t.Errorf("%s: bad value %q (%v)", name, value, err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompactionTrigger_Reached(t *testing.T) {
+	infos := []SegmentInfo{{Size: 100, LiveSize: 100}, {Size: 100, LiveSize: 40}}
+	for _, tc := range []struct {
+		trigger CompactionTrigger
+		reached bool
+	}{
+		{CompactionTrigger{}, true},
+		{CompactionTrigger{MinSegments: 2}, true},
+		{CompactionTrigger{MinSegments: 3}, false},
+		{CompactionTrigger{GarbageRatio: 0.3}, true},
+		{CompactionTrigger{GarbageRatio: 0.4}, false},
+		{CompactionTrigger{MinSegments: 3, GarbageRatio: 0.3}, true},
+	} {
+		if reached := tc.trigger.reached(infos); reached != tc.reached {
+			t.Errorf("Trigger %+v: expected %t, got %t", tc.trigger, tc.reached, reached)
+		}
+	}
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	stop := make(chan struct{})
+	limiter := newRateLimiter(10 * KB)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := limiter.wait(KB/2, stop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("2KB at 10KB/s took %s", elapsed)
+	}
+
+	close(stop)
+	if err := limiter.wait(10*KB, stop); err != errCompactionStopped {
+		t.Errorf("Expected errCompactionStopped, got %v", err)
+	}
+}
+
+func TestDb_CompactionStopsOnClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-compaction-close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// At a byte per second the merge cannot finish before Close.
+	db, err := NewDb(dir, 100, WithCompactionRate(1), WithCompactionTrigger(CompactionTrigger{MinSegments: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(createUniqueString(i%4), createUniqueString(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close waited %s for the merge", elapsed)
+	}
+	if stats := db.Stats(); stats.CompactionErrors != 0 {
+		t.Errorf("Interrupted merge is reported as failed: %v", stats.CompactionError)
+	}
+
+	// The reopened database does not merge, so merged files can only be left
+	// behind by the interrupted merge.
+	db, err = NewDb(dir, 100, WithCompactionTrigger(CompactionTrigger{MinSegments: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 16; i < 20; i++ {
+		if value, err := db.Get(createUniqueString(i % 4)); err != nil || value != createUniqueString(i) {
+			t.Errorf("Bad value %q (%v)", value, err)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.Contains(file.Name(), "-") {
+			t.Errorf("Interrupted merge left %s behind", file.Name())
+		}
+	}
+}
+
+func TestDb_GarbageCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-compaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 60+int64(segmentHeaderSize), WithCompactionPolicy(GarbageRatioPolicy{Threshold: 0.45}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The first segment keeps most of its data alive. The second one only
+	// holds an overwritten value and a tombstone for key1, which has to
+	// survive the merge while the first segment still holds key1.
+	for _, pair := range [][]string{{"key1", "value1"}, {"keyA", "value-of-keyA-16"}} {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Put("pad", "value-pad-10"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactor.waitIdle()
+	db.startCompaction()
+	db.compactor.waitIdle()
+
+	sgms := db.getSegments()
+	var names []string
+	for _, sgm := range sgms {
+		names = append(names, filepath.Base(sgm.outPath))
+	}
+	if len(sgms) != 3 || !strings.Contains(names[1], "-") {
+		t.Fatalf("Unexpected segments after compaction: %v", names)
+	}
+	if _, ok := sgms[1].index["key1"]; !ok {
+		t.Error("Tombstone shadowing an older segment is dropped")
+	}
+	if _, ok := sgms[1].index["pad"]; ok {
+		t.Error("Record shadowed by a newer segment is kept")
+	}
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Deleted key is found: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var recovered []string
+	for _, sgm := range db.getSegments()[:len(names)] {
+		recovered = append(recovered, filepath.Base(sgm.outPath))
+	}
+	if !equalStrings(names, recovered) {
+		t.Errorf("Bad segments order after recovery: expected %v, got %v", names, recovered)
+	}
+	for _, key := range []string{"pad", "keyA"} {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Cannot get %s: %s", key, err)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDb_SegmentsInfoCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-live-sizes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Segments are only merged once the trigger is reached, so that live
+	// sizes are measured both on top of known segments and after merges.
+	db, err := NewDb(dir, 100, WithCompactionTrigger(CompactionTrigger{GarbageRatio: 0.6}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 60; i++ {
+		if err := db.Put(createUniqueString(i%7), createUniqueString(i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			if err := db.Delete(createUniqueString(i % 5)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.compactor.waitIdle()
+
+		db.compactor.passMutex.Lock()
+		sgms := db.getSegments()
+		cached, err := db.segmentsInfo(sgms, newRateLimiter(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.compactor.measured = nil
+		measured, err := db.segmentsInfo(sgms, newRateLimiter(0))
+		db.compactor.passMutex.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range measured {
+			if cached[j] != measured[j] {
+				t.Fatalf("Write %d: cached %+v, measured %+v", i, cached[j], measured[j])
+			}
+		}
+	}
+	if db.Stats().Merges == 0 {
+		t.Error("Nothing was merged")
+	}
+
+	db.compactor.passMutex.Lock()
+	defer db.compactor.passMutex.Unlock()
+	db.compactor.measured = nil
+	limiter := newRateLimiter(1 << 40)
+	if _, err := db.segmentsInfo(db.getSegments(), limiter); err != nil {
+		t.Fatal(err)
+	}
+	if limiter.bytes == 0 {
+		t.Error("Index reads are not paced")
+	}
+}
+
+func TestDb_TriggerBeforeMeasuring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-trigger-measuring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100, WithCompactionTrigger(CompactionTrigger{MinSegments: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(createUniqueString(i%4), createUniqueString(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactor.waitIdle()
+	sgms := db.getSegments()
+	if len(sgms) < 3 {
+		t.Fatalf("Expected several segments, got %d", len(sgms))
+	}
+	for _, sgm := range sgms[:len(sgms)-1] {
+		if size, live := sgm.sizes(); size != live {
+			t.Errorf("Segment %s was measured before the trigger was reached", sgm.outPath)
+		}
+	}
+}
+
+func TestDb_WaitIdleWhileWriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-wait-idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if err := db.Put(createUniqueString(i%5), createUniqueString(i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		default:
+			db.compactor.waitIdle()
+		}
+	}
+	db.compactor.waitIdle()
+	if stats := db.Stats(); stats.Merges == 0 || stats.CompactionErrors != 0 {
+		t.Errorf("%d merges, %d failed passes (%v)", stats.Merges, stats.CompactionErrors, stats.CompactionError)
+	}
+
+	// Requests made once the worker is stopped are not waited for.
+	db.stopCompactor()
+	db.startCompaction()
+	db.compactor.waitIdle()
+}
@@ -0,0 +1,207 @@
+package datastore
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errCompactionStopped = fmt.Errorf("compaction stopped")
+
+// compactor is the worker that runs the compaction passes of a Db one at a
+// time in the background.
+type compactor struct {
+	// wake holds a pending request for a pass.
+	wake chan struct{}
+	// stop is closed by Db.Close, which interrupts the running pass.
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	// passMutex is held while a pass runs.
+	passMutex sync.Mutex
+	// measured lists the sealed segments of the last pass, and live holds
+	// their live sizes with regard to each other.
+	measured []*Segment
+	live     map[*Segment]int64
+
+	// errors counts failed passes and lastErr is the error of the latest.
+	errors  int64
+	mutex   sync.Mutex
+	lastErr error
+	// requests counts the requested passes that are not over yet, and idle
+	// is broadcast whenever it drops to zero. exited is set once the worker
+	// takes no more requests. All of them are guarded by mutex.
+	requests int
+	idle     *sync.Cond
+	exited   bool
+}
+
+func newCompactor() *compactor {
+	c := &compactor{
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	c.idle = sync.NewCond(&c.mutex)
+	return c
+}
+
+// startCompaction asks the compaction worker for a pass unless one is pending
+// already or the worker has exited.
+func (db *Db) startCompaction() {
+	c := db.compactor
+	c.mutex.Lock()
+	if c.exited {
+		c.mutex.Unlock()
+		return
+	}
+	c.requests++
+	c.mutex.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+		c.passOver()
+	}
+}
+
+// passOver marks a requested pass as over.
+func (c *compactor) passOver() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.requests--
+	if c.requests == 0 {
+		c.idle.Broadcast()
+	}
+}
+
+// waitIdle waits until the passes requested so far are over.
+func (c *compactor) waitIdle() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.requests > 0 {
+		c.idle.Wait()
+	}
+}
+
+// runCompactor runs compaction passes on request until the compactor stops.
+func (db *Db) runCompactor() {
+	c := db.compactor
+	defer close(c.done)
+	for {
+		select {
+		case <-c.stop:
+			// A pending request is dropped.
+			c.mutex.Lock()
+			c.exited = true
+			c.requests = 0
+			c.idle.Broadcast()
+			c.mutex.Unlock()
+			return
+		case <-c.wake:
+		}
+
+		c.passMutex.Lock()
+		err := db.compact()
+		if err == nil {
+			err = db.collectBlobs()
+		}
+		c.passMutex.Unlock()
+		if err != nil && err != errCompactionStopped {
+			log.Printf("Compaction failed: %s", err)
+			atomic.AddInt64(&c.errors, 1)
+			c.mutex.Lock()
+			c.lastErr = err
+			c.mutex.Unlock()
+		}
+		c.passOver()
+	}
+}
+
+// Compact merges every sealed segment into a single one, whatever the
+// compaction policy and trigger say. It waits for a running compaction pass
+// first.
+func (db *Db) Compact() error {
+	db.compactor.passMutex.Lock()
+	defer db.compactor.passMutex.Unlock()
+
+	db.writeIndexFiles()
+	if sgms := db.getSegments(); len(sgms) > 1 {
+		if err := db.mergeDbSegments(sgms, 0, len(sgms)-1); err != nil {
+			return err
+		}
+	}
+	if err := db.enforceIndexBudget(); err != nil {
+		return err
+	}
+	return db.collectBlobs()
+}
+
+// writeIndexFiles writes the hint files and Bloom filters of the segments
+// sealed since the last pass, before any of them is merged or loses its
+// in-memory index.
+func (db *Db) writeIndexFiles() {
+	sgms := db.getSegments()
+	for _, sgm := range sgms[:len(sgms)-1] {
+		sgm.writeIndexFiles()
+	}
+}
+
+// stopCompactor interrupts the running pass and waits for the worker to exit.
+func (db *Db) stopCompactor() {
+	c := db.compactor
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+}
+
+func (c *compactor) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *compactor) lastError() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastErr
+}
+
+// rateLimiter paces the bytes a merge reads and writes to rate bytes per
+// second. A non-positive rate leaves them unlimited.
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// wait accounts for n more bytes and sleeps until they are within the rate.
+// It gives up with errCompactionStopped once stop is closed.
+func (rl *rateLimiter) wait(n int64, stop <-chan struct{}) error {
+	if rl.rate <= 0 {
+		return nil
+	}
+	rl.bytes += n
+	due := rl.start.Add(time.Duration(float64(rl.bytes) / float64(rl.rate) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-stop:
+		return errCompactionStopped
+	}
+}
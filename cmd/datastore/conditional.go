@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrConflict is returned by conditional writes whose precondition does not
+// hold.
+var ErrConflict = fmt.Errorf("precondition failed")
+
+// Precondition is checked against the current version of a key before a
+// conditional write. The version of a key that does not exist is 0.
+type Precondition func(version uint64) bool
+
+// IfVersion holds when the key was last written with the given version.
+func IfVersion(version uint64) Precondition {
+	return func(current uint64) bool {
+		return current == version
+	}
+}
+
+// IfExists holds when the key has a value.
+func IfExists() Precondition {
+	return func(current uint64) bool {
+		return current != 0
+	}
+}
+
+// IfAbsent holds when the key has no value.
+func IfAbsent() Precondition {
+	return IfVersion(0)
+}
+
+// GetVersion returns the value of key together with its version, which grows
+// with every write to the database.
+func (db *Db) GetVersion(key string) (string, uint64, error) {
+	e, err := db.get(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if e.kind == recordBlob {
+		return db.readBlob(key)
+	}
+	return e.value, e.seq, nil
+}
+
+// readBlob reads the whole value of a key stored in a blob.
+func (db *Db) readBlob(key string) (string, uint64, error) {
+	vr, err := db.GetReader(key)
+	if err != nil {
+		return "", 0, err
+	}
+	defer vr.Close()
+	var value strings.Builder
+	value.Grow(int(vr.Size()))
+	if _, err := io.Copy(&value, vr); err != nil {
+		return "", 0, err
+	}
+	return value.String(), vr.Version(), nil
+}
+
+func (db *Db) currentVersion(key string) (uint64, error) {
+	e, err := db.get(key)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	return e.seq, err
+}
+
+// PutIf writes value if cond holds for the current version of key and returns
+// the new version.
+func (db *Db) PutIf(key, value string, cond Precondition) (uint64, error) {
+	return db.writeIf(entry{key: key, value: value, kind: recordPut}, cond)
+}
+
+// PutIfWithTTL works as PutIf for a value that expires once ttl passes.
+func (db *Db) PutIfWithTTL(key, value string, ttl time.Duration, cond Precondition) (uint64, error) {
+	return db.writeIf(entry{key: key, value: value, kind: recordPut, expires: db.now().Add(ttl).UnixNano()}, cond)
+}
+
+// DeleteIf deletes key if cond holds for its current version.
+func (db *Db) DeleteIf(key string, cond Precondition) error {
+	_, err := db.writeIf(entry{key: key, kind: recordDelete}, cond)
+	return err
+}
+
+// CompareAndSwap replaces the value of key with new if it currently equals
+// expected, and reports whether it did.
+func (db *Db) CompareAndSwap(key, expected, new string) (bool, error) {
+	_, err := db.writeData(ChannelData{data: entry{key: key, value: new, kind: recordPut}}, int64(len(new)), func() error {
+		value, err := db.Get(key)
+		if err != nil {
+			return err
+		}
+		if value != expected {
+			return ErrConflict
+		}
+		return nil
+	})
+	if err == ErrConflict || err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *Db) writeIf(e entry, cond Precondition) (uint64, error) {
+	return db.writeData(ChannelData{data: e}, int64(len(e.value)), func() error {
+		version, err := db.currentVersion(e.key)
+		if err != nil {
+			return err
+		}
+		if !cond(version) {
+			return ErrConflict
+		}
+		return nil
+	})
+}
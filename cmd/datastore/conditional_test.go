@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDb_ConditionalWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-conditional")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	v1, err := db.PutIf("key", "value1", IfAbsent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutIf("key", "value2", IfAbsent()); err != ErrConflict {
+		t.Errorf("Existing key is overwritten: %v", err)
+	}
+	if _, err := db.PutIf("key", "value2", IfVersion(v1+1)); err != ErrConflict {
+		t.Errorf("Version mismatch is not detected: %v", err)
+	}
+	v2, err := db.PutIf("key", "value2", IfVersion(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2 <= v1 {
+		t.Errorf("Version does not grow: %d after %d", v2, v1)
+	}
+
+	value, version, err := db.GetVersion("key")
+	if err != nil || value != "value2" || version != v2 {
+		t.Errorf("Bad versioned value: %s %d (%v)", value, version, err)
+	}
+
+	if err := db.DeleteIf("key", IfVersion(v1)); err != ErrConflict {
+		t.Errorf("Stale delete is applied: %v", err)
+	}
+	if err := db.DeleteIf("key", IfExists()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteIf("key", IfExists()); err != ErrConflict {
+		t.Errorf("Delete of an absent key is applied: %v", err)
+	}
+
+	t.Run("versions survive restart", func(t *testing.T) {
+		v, err := db.PutIf("key", "value3", IfAbsent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if _, version, err := db.GetVersion("key"); err != nil || version != v {
+			t.Errorf("Bad version after restart: %d (%v)", version, err)
+		}
+		if next, err := db.PutIf("key", "value4", IfVersion(v)); err != nil || next <= v {
+			t.Errorf("Bad version after restart: %d (%v)", next, err)
+		}
+	})
+}
+
+func TestDb_CompareAndSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if ok, err := db.CompareAndSwap("counter", "0", "1"); ok || err != nil {
+		t.Errorf("Absent key is swapped: %v %v", ok, err)
+	}
+	if err := db.Put("counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				value, err := db.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				current, _ := strconv.Atoi(value)
+				ok, err := db.CompareAndSwap("counter", value, strconv.Itoa(current+1))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					n++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := db.Get("counter"); value != fmt.Sprint(workers*increments) {
+		t.Errorf("Lost updates: counter is %s", value)
+	}
+}
@@ -3,247 +3,1029 @@ package datastore
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 const outFileName = "current-data"
 
-const marker = "marker"
+var ErrNotFound = fmt.Errorf("record does not exist")
 
-const mergingSegmentsNum = 2
+var errDeleted = fmt.Errorf("record is deleted")
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+type recordPosition struct {
+	offset int64
+	size   int64
+}
 
-type hashIndex map[string]int64
+type hashIndex map[string]recordPosition
+
+// TruncatedTail describes the damaged end of a segment file that was cut off
+// during recovery.
+type TruncatedTail struct {
+	Path    string
+	Offset  int64
+	Dropped int64
+}
 
 type Db struct {
 	segments    []*Segment
 	segmentSize int64
 	dir         string
+	policy      CompactionPolicy
+	// keys orders every key that has a record in one of the segments.
+	keys *skipList
+	// now tells the time records with a time to live expire against.
+	now func() time.Time
+	// compress makes new records and records rewritten by merges store
+	// their values deflated.
+	compress bool
+	values   valueStats
+	merged   mergeStats
+	keyring  *Keyring
+
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+
+	// cache, when set, holds the newest records of recently read keys.
+	cache *valueCache
+	// indexBudget, when positive, bounds the memory taken by the indexes of
+	// sealed segments.
+	indexBudget int64
+	// blobs holds the values written by PutReader that did not fit into a
+	// single chunk.
+	blobs *blobStore
+
+	// mutex guards segments. The slice is never modified in place, so
+	// readers may keep using a copy of it after unlocking.
+	mutex sync.RWMutex
+	// writeMutex serializes writers choosing the active segment and
+	// assigning sequence numbers.
+	writeMutex sync.Mutex
+	// seq is the sequence number of the latest write.
+	seq uint64
+	// pending counts writes passed to the active segment and not yet
+	// acknowledged by it.
+	pending sync.WaitGroup
+
+	// compactor runs compaction passes in the background, once trigger is
+	// reached, pacing the IO of merges to compactionRate bytes per second.
+	compactor      *compactor
+	trigger        CompactionTrigger
+	compactionRate int64
+
+	// manifestMutex serializes changes of the segment list, which are
+	// recorded in the manifest of generation.
+	manifestMutex sync.Mutex
+	generation    uint64
+
+	recovered []TruncatedTail
+	// lock keeps other processes from opening the directory until Close.
+	lock *dirLock
+}
+
+// Option configures a Db created by NewDb.
+type Option func(db *Db)
+
+// WithCompactionPolicy replaces DefaultCompactionPolicy.
+func WithCompactionPolicy(policy CompactionPolicy) Option {
+	return func(db *Db) {
+		db.policy = policy
+	}
+}
+
+// WithCompactionTrigger makes compaction passes wait for trigger instead of
+// running whenever a new segment is started.
+func WithCompactionTrigger(trigger CompactionTrigger) Option {
+	return func(db *Db) {
+		db.trigger = trigger
+	}
+}
 
-	mutex           sync.Mutex
-	mergeInProgress bool
+// WithCompactionRate limits the bytes merges read and write to bytesPerSecond.
+// Without this option merges run at full speed.
+func WithCompactionRate(bytesPerSecond int64) Option {
+	return func(db *Db) {
+		db.compactionRate = bytesPerSecond
+	}
+}
+
+// WithCompression stores values deflated whenever that makes them shorter.
+// Databases written with and without compression can be opened either way.
+func WithCompression() Option {
+	return func(db *Db) {
+		db.compress = true
+	}
+}
+
+// WithEncryption encrypts values of new records and of records rewritten by
+// merges with the current key of keyring. The keyring must also hold the keys
+// of records written earlier.
+func WithEncryption(keyring *Keyring) Option {
+	return func(db *Db) {
+		db.keyring = keyring
+	}
 }
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
+// WithSync sets when writes are flushed to stable storage. The interval is
+// only used by SyncInterval, and DefaultSyncInterval replaces a non-positive
+// one. Without this option writes are never flushed explicitly.
+func WithSync(policy SyncPolicy, interval time.Duration) Option {
+	return func(db *Db) {
+		if interval <= 0 {
+			interval = DefaultSyncInterval
+		}
+		db.syncPolicy = policy
+		db.syncInterval = interval
+	}
+}
+
+// WithIndexBudget bounds the memory taken by the indexes of sealed segments.
+// Once their estimated size goes over budget, the oldest segments switch to a
+// sparse in-memory index backed by their sorted hint files. The index of the
+// active segment is always kept in memory.
+func WithIndexBudget(budget int64) Option {
+	return func(db *Db) {
+		db.indexBudget = budget
+	}
+}
+
+// WithCache keeps recently read values in memory, using up to size bytes.
+func WithCache(size int64) Option {
+	return func(db *Db) {
+		if size > 0 {
+			db.cache = newValueCache(size)
+		}
+	}
+}
+
+func NewDb(dir string, segmentSize int64, opts ...Option) (*Db, error) {
 	db := &Db{
 		segments:    []*Segment{},
 		segmentSize: segmentSize,
 		dir:         dir,
+		policy:      DefaultCompactionPolicy,
+		keys:        newSkipList(),
+		now:         time.Now,
+		compactor:   newCompactor(),
 	}
-	err := db.recover()
-	if err != nil && err != io.EOF {
+	for _, opt := range opts {
+		opt(db)
+	}
+	if err := checkPolicy(db.policy); err != nil {
 		return nil, err
 	}
-	_, err = db.createDbSegment()
+	lock, err := lockDir(dir)
 	if err != nil {
 		return nil, err
 	}
+	db.lock = lock
+	if err := db.open(); err != nil {
+		lock.release()
+		return nil, err
+	}
+	go db.runCompactor()
 	return db, nil
 }
 
-func (db *Db) createDbSegment() (*Segment, error) {
-	name := time.Now().UnixNano()
-	segmentPath := filepath.Join(db.dir, strconv.FormatInt(name, 10))
-
-	sgm, err := NewSegment(true, segmentPath, db.segmentSize)
+func (db *Db) open() error {
+	db.blobs = newBlobStore(db)
+	err := db.recover()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err := db.collectBlobs(); err != nil {
+		log.Printf("Removing unreferenced blobs failed: %s", err)
+	}
+	_, err = db.createDbSegment()
+	return err
+}
 
+// Segment files are named after their creation time in nanoseconds. A merged
+// segment takes the creation time of the newest segment it replaces followed
+// by "-n", where n counts the merges that time went through. This sorts it
+// right after the segment it replaces and before any newer segment, while the
+// name keeps its length however often the segment is rewritten.
+func mergedName(newest string) string {
+	key, err := segmentNameKey(newest)
 	if err != nil {
-		return nil, err
+		return newest + "-1"
+	}
+	var n int64
+	if len(key) > 1 {
+		n = key[1]
 	}
+	return strconv.FormatInt(key[0], 10) + "-" + strconv.FormatInt(n+1, 10)
+}
 
-	db.segments = append(db.segments, sgm)
+// segmentNameKey splits a segment file name into the numbers it is sorted by.
+func segmentNameKey(name string) ([]int64, error) {
+	parts := strings.Split(name, "-")
+	key := make([]int64, len(parts))
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected segment file name %q", name)
+		}
+		key[i] = n
+	}
+	return key, nil
+}
 
-	if len(db.segments) > mergingSegmentsNum {
-		go db.mergeDbSegments()
+func lessSegmentKey(a, b []int64) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
 	}
-	return sgm, err
+	return len(a) < len(b)
 }
 
-func (db *Db) mergeDbSegments() error {
+// newSegment opens a segment that shares the statistics, the keyring and the
+// sync policy of the database.
+func (db *Db) newSegment(isActive bool, path string) (*Segment, error) {
+	return openSegment(isActive, path, db.segmentSize, db.segmentConfig())
+}
 
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
+func (db *Db) segmentConfig() segmentConfig {
+	return segmentConfig{
+		values:       &db.values,
+		keyring:      db.keyring,
+		syncPolicy:   db.syncPolicy,
+		syncInterval: db.syncInterval,
+	}
+}
 
-	if db.mergeInProgress == true {
-		return nil
+func (db *Db) getSegments() []*Segment {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.segments
+}
+
+// acquireSegments returns the current segments, keeping their files on disk
+// until releaseSegments is called.
+func (db *Db) acquireSegments() []*Segment {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	for _, sgm := range db.segments {
+		sgm.acquire()
 	}
+	return db.segments
+}
 
-	db.mergeInProgress = true
+func releaseSegments(sgms []*Segment) {
+	for _, sgm := range sgms {
+		sgm.release()
+	}
+}
 
-	mergeList := db.segments[0:mergingSegmentsNum]
+func (db *Db) createDbSegment() (*Segment, error) {
+	name := time.Now().UnixNano()
+	segmentPath := filepath.Join(db.dir, strconv.FormatInt(name, 10))
 
-	data := make(map[string]string)
+	sgm, err := db.newSegment(true, segmentPath)
 
-	for _, sgm := range mergeList {
-		allData, err := sgm.GetAllData()
+	if err != nil {
+		return nil, err
+	}
 
+	err = db.commitSegments(func(segments []*Segment) []*Segment {
+		return append(segments[:len(segments):len(segments)], sgm)
+	})
+	if err != nil {
+		sgm.Close()
+		sgm.removeFiles()
+		return nil, err
+	}
+
+	db.startCompaction()
+	return sgm, err
+}
+
+// compact merges the segments picked by the compaction policy until it has
+// nothing more to pick or the compaction trigger is no longer reached. A pick
+// of a single segment without dead records ends the pass as well, since
+// rewriting it would gain nothing and the policy would pick it again.
+func (db *Db) compact() error {
+	db.writeIndexFiles()
+	for {
+		if db.compactor.stopped() {
+			return errCompactionStopped
+		}
+		sgms := db.getSegments()
+		if !db.trigger.reachedBy(len(sgms)-1) && db.trigger.GarbageRatio <= 0 {
+			// Only the garbage ratio needs the live sizes.
+			return db.enforceIndexBudget()
+		}
+
+		infos, err := db.segmentsInfo(sgms, newRateLimiter(db.compactionRate))
 		if err != nil {
 			return err
 		}
+		from, to := 0, 0
+		if db.trigger.reached(infos) {
+			from, to = db.policy.Pick(infos)
+		}
+		if from < 0 || from > to || to > len(infos) {
+			return fmt.Errorf("compaction policy picked segments [%d, %d) of %d", from, to, len(infos))
+		}
+		if from >= to || to-from == 1 && infos[from].LiveSize >= infos[from].Size {
+			return db.enforceIndexBudget()
+		}
+		if err := db.mergeDbSegments(sgms, from, to); err != nil {
+			return err
+		}
+	}
+}
 
-		for key, val := range allData {
+// segmentsInfo describes all segments but the active one, which is the last in
+// sgms. The live sizes of the sealed segments with regard to the newer sealed
+// ones are kept by the compactor: while segments are only sealed on top of the
+// known ones, just the keys of the new ones are looked up in the older ones.
+// The keys of the active segment are looked up on every call. Index reads are
+// paced by limiter.
+func (db *Db) segmentsInfo(sgms []*Segment, limiter *rateLimiter) ([]SegmentInfo, error) {
+	c := db.compactor
+	sealed, active := sgms[:len(sgms)-1], sgms[len(sgms)-1]
 
-			if val == marker {
-				delete(data, key)
-			} else {
-				data[key] = val
+	known := len(c.measured)
+	if known > len(sealed) || !sameSegments(c.measured, sealed[:known]) {
+		known = 0
+		c.measured, c.live = nil, nil
+	}
+	live := make(map[*Segment]int64, len(sealed))
+	for _, sgm := range sealed[:known] {
+		live[sgm] = c.live[sgm]
+	}
+	for i := known; i < len(sealed); i++ {
+		own, err := db.shadow(sealed[i], sealed[:i], limiter, func(j int, size int64) {
+			live[sealed[j]] -= size
+		})
+		if err != nil {
+			return nil, err
+		}
+		if sealed[i].offset() >= int64(segmentHeaderSize) {
+			// The header is never garbage.
+			own += int64(segmentHeaderSize)
+		}
+		live[sealed[i]] = own
+	}
+	c.measured, c.live = append([]*Segment(nil), sealed...), live
+
+	infos := make([]SegmentInfo, len(sealed))
+	for i, sgm := range sealed {
+		infos[i] = SegmentInfo{
+			Name:     filepath.Base(sgm.outPath),
+			Size:     sgm.offset(),
+			LiveSize: live[sgm],
+		}
+	}
+	_, err := db.shadow(active, sealed, limiter, func(j int, size int64) {
+		infos[j].LiveSize -= size
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, sgm := range sealed {
+		sgm.setLiveSize(infos[i].LiveSize)
+	}
+	return infos, nil
+}
+
+// shadow looks up every key of sgm in the older segments and calls fn with the
+// position in older of the newest one holding it and the size of its record
+// there, which sgm makes dead. It returns the size of the records of sgm.
+func (db *Db) shadow(sgm *Segment, older []*Segment, limiter *rateLimiter, fn func(i int, size int64)) (int64, error) {
+	var own int64
+	var err error
+	forEachErr := sgm.forEach(func(key string, pos recordPosition) bool {
+		own += pos.size
+		for i := len(older) - 1; i >= 0; i-- {
+			if err = limiter.wait(indexSize(1, int64(len(key))), db.compactor.stop); err != nil {
+				return false
+			}
+			var olderPos recordPosition
+			var ok bool
+			if olderPos, ok, err = older[i].lookup(key); err != nil {
+				return false
+			}
+			if ok {
+				fn(i, olderPos.size)
+				break
 			}
 		}
+		return true
+	})
+	if err == nil {
+		err = forEachErr
 	}
+	return own, err
+}
 
-	systemSegmentPath := filepath.Join(db.dir, "system-segment")
-	sgm, err := NewSegment(true, systemSegmentPath, db.segmentSize)
+func sameSegments(a, b []*Segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeDbSegments replaces sgms[from:to] with a single segment holding the
+// latest record of each of their keys that is not shadowed by a newer segment.
+// Writes to the active segment carry on while the merged segment is being
+// written.
+func (db *Db) mergeDbSegments(sgms []*Segment, from, to int) error {
+	start := time.Now()
+	limiter := newRateLimiter(db.compactionRate)
+	mergeList := sgms[from:to]
+	mergedPath := filepath.Join(db.dir, mergedName(filepath.Base(mergeList[len(mergeList)-1].outPath)))
 
+	// rewritten holds the blobs copied to be sealed with the current key,
+	// which replace the originals once the merge is committed, and
+	// rewrittenKeys their keys.
+	var rewritten []int64
+	var rewrittenKeys []string
+	committed := false
+	defer func() {
+		for _, id := range rewritten {
+			if !committed {
+				os.Remove(db.blobs.path(id))
+			}
+			db.blobs.done(id)
+		}
+	}()
+
+	var w *segmentWriter
+	dropped, err := mergeSegmentsData(mergeList, sgms[:from], sgms[to:], db.now(), func(e entry, size int64) error {
+		if e.kind == recordBlob {
+			stale, err := db.blobs.stale(e)
+			if err != nil {
+				return err
+			}
+			if stale {
+				var id int64
+				if e, id, err = db.blobs.rewrite(e); err != nil {
+					return err
+				}
+				rewritten = append(rewritten, id)
+				rewrittenKeys = append(rewrittenKeys, e.key)
+				_, blobSize, _ := e.blob()
+				if err := limiter.wait(2*blobSize, db.compactor.stop); err != nil {
+					return err
+				}
+			}
+		}
+		if w == nil {
+			var err error
+			if w, err = newSegmentWriter(mergedPath, db.segmentConfig()); err != nil {
+				return err
+			}
+		}
+		e.compressed = db.compress
+		written, err := w.write(e)
+		if err != nil {
+			return err
+		}
+		return limiter.wait(size+written, db.compactor.stop)
+	})
 	if err != nil {
+		if w != nil {
+			w.abort()
+		}
 		return err
 	}
 
-	for key, val := range data {
-		errorChannel := make(chan error)
-		sgm.Put(ChannelData{
-			data: entry{
-				key:   key,
-				value: val,
-			},
-			errorChannel: errorChannel,
-		})
-		err := <-errorChannel
+	var merged []*Segment
+	// evicted collects keys that may no longer be held by any in-memory
+	// index once the merge is done.
+	evicted := dropped
+	if w != nil {
+		sgm, err := w.finish()
 		if err != nil {
 			return err
 		}
+		// Keys of segments with a sparse index are not in the skip list, so a
+		// merge of them is kept sparse as well.
+		sparse := false
+		for _, input := range mergeList {
+			if !input.inMemory() {
+				sparse = true
+			}
+		}
+		if sparse {
+			for _, input := range mergeList {
+				evicted = append(evicted, input.indexKeys()...)
+			}
+			if err := sgm.useSparseIndex(); err != nil {
+				sgm.removeFiles()
+				return err
+			}
+		}
+		merged = append(merged, sgm)
 	}
 
-	sgm.removeWritingLoop()
+	err = db.commitSegments(func(current []*Segment) []*Segment {
+		segments := make([]*Segment, 0, len(current)-len(mergeList)+len(merged))
+		segments = append(segments, current[:from]...)
+		segments = append(segments, merged...)
+		return append(segments, current[to:]...)
+	})
+	if err != nil {
+		for _, sgm := range merged {
+			sgm.removeFiles()
+		}
+		return err
+	}
+	committed = true
+	if db.cache != nil {
+		// Cached records still reference the blobs that were copied.
+		for _, key := range rewrittenKeys {
+			db.cache.invalidate(key)
+		}
+	}
 
-	segments := []*Segment{sgm}
+	db.keys.DeleteUnless(evicted, db.inMemoryKey)
 
-	for _, seg := range db.segments[mergingSegmentsNum:] {
-		segments = append(segments, seg)
+	for _, sgm := range mergeList {
+		sgm.retire()
 	}
 
-	fmt.Println(len(segments))
+	db.merged.track(start)
+	return nil
+}
 
-	db.segments = segments
+// mergeSegmentsData walks the latest record of every key of segments, which
+// are ordered from oldest to newest, in key order and passes the ones a merge
+// of them has to keep to emit. Keys written again in one of the newer segments
+// are skipped. Records expired by now are turned into tombstones, and a
+// tombstone is only kept while one of the older segments still holds a record
+// for its key. emit also gets the size of the record read. The keys of dropped
+// tombstones are returned.
+func mergeSegmentsData(segments, older, newer []*Segment, now time.Time, emit func(e entry, size int64) error) ([]string, error) {
+	cursors := make([]indexCursor, len(segments))
+	heads := make([]indexEntry, len(segments))
+	live := make([]bool, len(segments))
+	advance := func(i int) error {
+		key, pos, ok, err := cursors[i].next()
+		heads[i], live[i] = indexEntry{key, pos}, ok
+		return err
+	}
+	for i, sgm := range segments {
+		cursors[i] = sgm.cursor()
+		if err := advance(i); err != nil {
+			return nil, err
+		}
+	}
 
-	for _, sgm := range mergeList {
-		err := os.Remove(sgm.outPath)
+	var dropped []string
+	for {
+		// newest is the newest segment holding the smallest key left.
+		newest := -1
+		for i := range segments {
+			if live[i] && (newest < 0 || heads[i].key <= heads[newest].key) {
+				newest = i
+			}
+		}
+		if newest < 0 {
+			return dropped, nil
+		}
+		key, pos := heads[newest].key, heads[newest].pos
+		for i := range segments {
+			if live[i] && heads[i].key == key {
+				if err := advance(i); err != nil {
+					return nil, err
+				}
+			}
+		}
 
+		shadowed, err := containsKey(newer, key)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if shadowed {
+			continue
+		}
+		e, err := segments[newest].readAt(pos)
+		if err != nil {
+			return nil, err
+		}
+		if e.expired(now) {
+			e = entry{key: key, kind: recordDelete, seq: e.seq}
+		}
+		if e.deleted() {
+			kept, err := containsKey(older, key)
+			if err != nil {
+				return nil, err
+			}
+			if !kept {
+				dropped = append(dropped, key)
+				continue
+			}
+		}
+		if err := emit(e, pos.size); err != nil {
+			return nil, err
 		}
 	}
+}
 
-	db.mergeInProgress = false
+func containsKey(segments []*Segment, key string) (bool, error) {
+	for _, sgm := range segments {
+		_, ok, err := sgm.lookup(key)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// inMemoryKey reports whether one of the segments with an in-memory index
+// holds key.
+func (db *Db) inMemoryKey(key string) bool {
+	for _, sgm := range db.getSegments() {
+		sgm.mutex.Lock()
+		_, ok := sgm.index[key]
+		sgm.mutex.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceIndexBudget moves the indexes of the oldest sealed segments out of
+// memory until the rest fit into the index budget.
+func (db *Db) enforceIndexBudget() error {
+	if db.indexBudget <= 0 {
+		return nil
+	}
+	sgms := db.getSegments()
+	sealed := sgms[:len(sgms)-1]
+	sizes := make([]int64, len(sealed))
+	var used int64
+	for i, sgm := range sealed {
+		if sgm.inMemory() {
+			sizes[i] = sgm.indexSize()
+			used += sizes[i]
+		}
+	}
+	for i, sgm := range sealed {
+		if used <= db.indexBudget {
+			break
+		}
+		if sizes[i] == 0 {
+			continue
+		}
+		keys := sgm.indexKeys()
+		if err := sgm.useSparseIndex(); err != nil {
+			return err
+		}
+		used -= sizes[i]
+		db.keys.DeleteUnless(keys, db.inMemoryKey)
+	}
 	return nil
 }
 
+// recover loads the segments listed in the manifest and removes the files of
+// any other segment. Segments of the legacy layout are upgraded first.
 func (db *Db) recover() error {
-	files, err := ioutil.ReadDir(db.dir)
+	names, err := db.segmentNames()
 	if err != nil {
 		return err
 	}
 	var segments []string
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-		segments = append(segments, file.Name())
-	}
-	sort.SliceStable(segments, func(i, j int) bool {
-		iTime, err := strconv.Atoi(segments[i])
+	upgraded := map[string]bool{}
+	// seq is the highest version in the first scanned segments, which
+	// upgraded records follow.
+	var seq uint64
+	scanned := 0
+	for _, name := range names {
+		path := filepath.Join(db.dir, name)
+		legacy, err := isLegacySegment(path)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("manifest lists segment %s: %w", name, err)
 		}
-		jTime, err := strconv.Atoi(segments[j])
-		if err != nil {
-			log.Fatal(err)
+		if legacy {
+			// A crash may have come between upgrades, which leaves upgraded
+			// segments before this one.
+			for ; scanned < len(segments); scanned++ {
+				max, err := maxSegmentSeq(filepath.Join(db.dir, segments[scanned]))
+				if err != nil {
+					return err
+				}
+				if max > seq {
+					seq = max
+				}
+			}
+			if name, err = upgradeSegment(db.dir, name, &seq); err != nil {
+				return err
+			}
+			log.Printf("Segment %s: upgraded from the legacy layout", name)
+			upgraded[name] = true
+			scanned++
+		} else if upgraded[name] {
+			// A crash after upgrading the legacy merge output left it behind.
+			continue
 		}
-		return time.Unix(0, int64(iTime)).Before(time.Unix(0, int64(jTime)))
-	})
+		segments = append(segments, name)
+	}
+	if err := db.removeStrayFiles(segments); err != nil {
+		return err
+	}
+	var loaded []*Segment
 	for _, name := range segments {
-		path := filepath.Join(db.dir, name)
-		sgm, err := NewSegment(false, path, db.segmentSize)
+		sgm, err := db.loadSegment(name)
 		if err != nil {
 			return err
 		}
-		err = sgm.recover()
-		if err != nil && err != io.EOF {
-			return err
+		loaded = append(loaded, sgm)
+	}
+	db.fitIndexes(loaded)
+	for _, sgm := range loaded {
+		db.addSegment(sgm)
+	}
+	return nil
+}
+
+// loadSegment opens a segment found in the directory. With an index budget,
+// its index is left on disk whenever its hint file allows it.
+func (db *Db) loadSegment(name string) (*Segment, error) {
+	path := filepath.Join(db.dir, name)
+	sgm, err := db.newSegment(false, path)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := db.indexBudget > 0 && sgm.loadSparse() == nil
+	if !loaded {
+		if err := sgm.loadHint(); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Segment %s: ignoring hint file: %s", name, err)
+			}
+
+			dropped, err := sgm.recover()
+			if err != nil {
+				return nil, err
+			}
+			if dropped > 0 {
+				log.Printf("Segment %s: dropped %d bytes of torn or corrupted tail at offset %d", name, dropped, sgm.outOffset)
+				db.recovered = append(db.recovered, TruncatedTail{Path: path, Offset: sgm.outOffset, Dropped: dropped})
+			}
+			if err := sgm.writeHint(); err != nil {
+				log.Printf("Segment %s: cannot write hint file: %s", name, err)
+			}
+		} else if db.indexBudget > 0 {
+			// The hint may come from a version that did not sort it.
+			if err := sgm.writeHint(); err != nil {
+				log.Printf("Segment %s: cannot write hint file: %s", name, err)
+			}
 		}
-		db.segments = append(db.segments, sgm)
 	}
-	return err
+	if err := sgm.loadBloom(); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Segment %s: ignoring bloom filter: %s", name, err)
+		}
+		if err := sgm.buildBloom(); err != nil {
+			log.Printf("Segment %s: cannot write bloom filter: %s", name, err)
+		}
+	}
+	return sgm, nil
 }
 
-func (db *Db) Close() error {
-	for _, sgm := range db.segments {
-		err := sgm.Close()
+// fitIndexes keeps the indexes of the newest recovered segments in memory as
+// long as they fit into the index budget, and leaves the others on disk.
+func (db *Db) fitIndexes(sgms []*Segment) {
+	if db.indexBudget <= 0 {
+		return
+	}
+	var used int64
+	for i := len(sgms) - 1; i >= 0; i-- {
+		sgm := sgms[i]
+		size := sgm.indexSize()
+		var err error
+		if used+size <= db.indexBudget {
+			if !sgm.inMemory() {
+				err = sgm.useFullIndex()
+			}
+			if err == nil {
+				used += size
+			}
+		} else if sgm.inMemory() {
+			err = sgm.useSparseIndex()
+		}
 		if err != nil {
-			return err
+			log.Printf("Segment %s: %s", sgm.outPath, err)
 		}
 	}
-	return nil
+}
+
+// addSegment appends a recovered segment. Only keys of an in-memory index are
+// added to the skip list.
+func (db *Db) addSegment(sgm *Segment) {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+	for key := range sgm.index {
+		db.keys.Insert(key)
+	}
+	if sgm.maxSeq > db.seq {
+		db.seq = sgm.maxSeq
+	}
+	db.segments = append(db.segments, sgm)
+}
+
+// Recovered reports the segment tails that were truncated when the database
+// was opened.
+func (db *Db) Recovered() []TruncatedTail {
+	return db.recovered
+}
+
+func (db *Db) Close() error {
+	db.stopCompactor()
+
+	// Every segment is closed and the directory unlocked even when one of
+	// them fails, and the first error is returned.
+	var err error
+	for _, sgm := range db.getSegments() {
+		if closeErr := sgm.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if releaseErr := db.lock.release(); err == nil {
+		err = releaseErr
+	}
+	return err
 }
 
 func (db *Db) Get(key string) (string, error) {
-	sgms := db.segments
+	value, _, err := db.GetVersion(key)
+	return value, err
+}
 
-	for _, sgm := range sgms {
-		val, err := sgm.Get(key)
+// GetBytes works as Get for binary keys and values.
+func (db *Db) GetBytes(key []byte) ([]byte, error) {
+	value, err := db.Get(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// get returns the newest live record of key.
+func (db *Db) get(key string) (entry, error) {
+	if db.cache == nil {
+		return db.readNewest(key)
+	}
+	if e, ok := db.cache.get(key); ok {
+		if e.expired(db.now()) {
+			return entry{}, ErrNotFound
+		}
+		return e, nil
+	}
+	epoch := db.cache.epoch(key)
+	e, err := db.readNewest(key)
+	if err == nil {
+		db.cache.add(e, epoch)
+	}
+	return e, err
+}
+
+// readNewest looks the newest live record of key up in the segments.
+func (db *Db) readNewest(key string) (entry, error) {
+	sgms := db.acquireSegments()
+	defer releaseSegments(sgms)
+
+	for i := len(sgms) - 1; i >= 0; i-- {
+		e, err := sgms[i].getEntry(key)
 
 		if err == nil {
-			return val, nil
+			if e.deleted() || e.expired(db.now()) {
+				return entry{}, ErrNotFound
+			}
+			return e, nil
 		}
 		if err != ErrNotFound {
-			return "", err
+			return entry{}, err
 		}
 	}
 
-	return "", fmt.Errorf("Some end error")
+	return entry{}, ErrNotFound
 }
 
 func (db *Db) Put(key, value string) error {
-	e := entry{
+	return db.write(entry{
 		key:   key,
 		value: value,
+		kind:  recordPut,
+	})
+}
+
+// PutBytes works as Put for binary keys and values. The slices are copied.
+func (db *Db) PutBytes(key, value []byte) error {
+	return db.Put(string(key), string(value))
+}
+
+// PutWithTTL writes value that expires once ttl passes.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	return db.write(entry{
+		key:     key,
+		value:   value,
+		kind:    recordPut,
+		expires: db.now().Add(ttl).UnixNano(),
+	})
+}
+
+func (db *Db) Delete(key string) error {
+	return db.write(entry{
+		key:  key,
+		kind: recordDelete,
+	})
+}
+
+func (db *Db) write(e entry) error {
+	_, err := db.writeData(ChannelData{data: e}, int64(len(e.value)), nil)
+	return err
+}
+
+// writeData appends data to the active segment, starting a new one first if
+// size more bytes of values do not fit into it. Every record of data gets the
+// same new sequence number, which is returned. When check is given, it is
+// called once all earlier writes are applied, and its error cancels the write.
+func (db *Db) writeData(data ChannelData, size int64, check func() error) (uint64, error) {
+	db.writeMutex.Lock()
+
+	if check != nil {
+		db.pending.Wait()
+		if err := check(); err != nil {
+			db.writeMutex.Unlock()
+			return 0, err
+		}
 	}
 
-	currentSegment := db.segments[len(db.segments)-1]
+	sgms := db.getSegments()
+	currentSegment := sgms[len(sgms)-1]
 
-	currentOffset := currentSegment.outOffset
+	currentOffset := currentSegment.offset()
 
-	if currentOffset+int64(len(value)) > db.segmentSize {
-		currentSegment.removeWritingLoop()
-		currentSegment.out.Close()
+	if currentOffset+size > db.segmentSize {
+		if err := currentSegment.seal(); err != nil {
+			log.Printf("Segment %s: %s", currentSegment.outPath, err)
+		}
 		sgm, err := db.createDbSegment()
 
 		if err != nil {
-			return err
+			db.writeMutex.Unlock()
+			return 0, err
 		}
 
 		currentSegment = sgm
 	}
+
+	db.seq++
+	seq := db.seq
+	if data.batch == nil {
+		data.data.seq = seq
+		data.data.compressed = db.compress
+	}
+	for i := range data.batch {
+		data.batch[i].seq = seq
+		data.batch[i].compressed = db.compress
+	}
+
 	errorChannel := make(chan error)
-	err := currentSegment.Put(ChannelData{
-		data:         e,
-		errorChannel: errorChannel,
-	})
+	data.errorChannel = errorChannel
+	err := currentSegment.Put(data)
+	if err == nil {
+		db.pending.Add(1)
+		defer db.pending.Done()
+	}
+	db.writeMutex.Unlock()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	err = <-errorChannel
+	if err != nil {
+		return 0, err
 	}
-	return <-errorChannel
-}
-
-func (db *Db) Delete(key string) error {
-	err := db.Put(key, marker)
 
-	return err
+	if data.batch == nil {
+		db.keys.Insert(data.data.key)
+		if db.cache != nil {
+			db.cache.invalidate(data.data.key)
+		}
+	}
+	for _, e := range data.batch {
+		db.keys.Insert(e.key)
+		if db.cache != nil {
+			db.cache.invalidate(e.key)
+		}
+	}
+	return seq, nil
 }
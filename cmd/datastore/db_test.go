@@ -1,9 +1,13 @@
 package datastore
 
 import (
+	"bytes"
+	"errors"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 const segmentSize = 10240
@@ -98,3 +102,297 @@ func TestDb_Delete(t *testing.T) {
 		}
 	})
 }
+
+func TestDb_Tombstones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-tombstones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 60, WithCompactionPolicy(SizeTieredPolicy{MinSegments: 2, BucketHigh: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, pair := range [][]string{{"key1", "marker"}, {"key2", "value2"}, {"key3", "value3"}} {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.segments) != 2 {
+		t.Fatalf("Tombstone is expected in a new segment, got %d segments", len(db.segments))
+	}
+
+	t.Run("deleted in newer segment", func(t *testing.T) {
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("Deleted key is found: %v", err)
+		}
+	})
+
+	if err := db.Put("key4", strings.Repeat("v", 60)); err != nil {
+		t.Fatal(err)
+	}
+	db.compactor.waitIdle()
+
+	t.Run("merge", func(t *testing.T) {
+		sgms := db.getSegments()
+		if len(sgms) != 2 {
+			t.Fatalf("Segments are not merged")
+		}
+		if _, ok := sgms[0].index["key2"]; ok {
+			t.Error("Tombstone is not dropped by merge")
+		}
+		value, err := db.Get("key1")
+		if err != nil || value != "marker" {
+			t.Errorf("Bad value for key1: %s (%v)", value, err)
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("Deleted key is found after merge: %v", err)
+		}
+	})
+}
+
+func TestDb_TTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 60, WithCompactionPolicy(SizeTieredPolicy{MinSegments: 2, BucketHigh: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	db.now = func() time.Time { return now }
+
+	if err := db.PutWithTTL("session", "token", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("before expiration", func(t *testing.T) {
+		value, err := db.Get("session")
+		if err != nil || value != "token" {
+			t.Errorf("Bad value for session: %s (%v)", value, err)
+		}
+	})
+
+	now = now.Add(2 * time.Minute)
+
+	t.Run("after expiration", func(t *testing.T) {
+		if _, err := db.Get("session"); err != ErrNotFound {
+			t.Errorf("Expired key is found: %v", err)
+		}
+		if _, err := db.Get("key1"); err != nil {
+			t.Errorf("Key without ttl is not found: %v", err)
+		}
+	})
+
+	for _, pair := range [][]string{{"key2", strings.Repeat("v", 60)}, {"key3", "value3"}} {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactor.waitIdle()
+	db.startCompaction()
+	db.compactor.waitIdle()
+
+	t.Run("merge", func(t *testing.T) {
+		for _, sgm := range db.getSegments() {
+			if _, ok := sgm.index["session"]; ok {
+				t.Error("Expired record is not dropped by merge")
+			}
+		}
+		if _, ok := db.keys.Next("session", true); ok {
+			t.Error("Expired key is left in the key index")
+		}
+		value, err := db.Get("key1")
+		if err != nil || value != "value1" {
+			t.Errorf("Bad value for key1: %s (%v)", value, err)
+		}
+	})
+}
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-compression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	document := strings.Repeat(`{"name": "value", "items": [1, 2, 3]}`, 50)
+	db, err = NewDb(dir, segmentSize, WithCompression())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("document", document); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]string{"plain": "value", "document": document} {
+		value, err := db.Get(key)
+		if err != nil || value != expected {
+			t.Errorf("Bad value for %s: %.20s (%v)", key, value, err)
+		}
+	}
+
+	stats := db.Stats()
+	if stats.ValueBytes != int64(len(document)) {
+		t.Errorf("Unexpected value bytes: %d", stats.ValueBytes)
+	}
+	if ratio := stats.CompressionRatio(); ratio < 2 {
+		t.Errorf("Unexpected compression ratio: %f", ratio)
+	}
+}
+
+func BenchmarkDb_Get(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench-db-get")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 64*KB)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		if err := db.Put(createUniqueString(i), strings.Repeat("v", 100)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	db.compactor.waitIdle()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := db.Get(createUniqueString(i % keys)); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func TestDb_Bytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte{0, 1, 0xff, '/', 0}
+	value := []byte{0xde, 0xad, 0, 0xbe, 0xef, '\n'}
+	if err := db.PutBytes(key, value); err != nil {
+		t.Fatal(err)
+	}
+	key[0] = 'k'
+	if _, err := db.GetBytes(key); err != ErrNotFound {
+		t.Errorf("Key is not copied by PutBytes: %v", err)
+	}
+	key[0] = 0
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	got, err := db.GetBytes(key)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Errorf("Bad binary value: %v (%v)", got, err)
+	}
+}
+
+func TestDb_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir, segmentSize); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatalf("Cannot reopen closed db: %s", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDb_CloseReleasesLockOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-close-error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	// A reader closed behind the segment's back makes closing it fail.
+	if err := db.getSegments()[0].in.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err == nil {
+		t.Error("Expected an error from closing the segment")
+	}
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatalf("Cannot reopen db after a failed close: %s", err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key1"); err != nil || value != "value1" {
+		t.Errorf("Bad value for key1: %s (%v)", value, err)
+	}
+}
@@ -0,0 +1,43 @@
+package datastore
+
+import "time"
+
+// SyncPolicy tells when writes to the active segment are flushed to stable
+// storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system, so a machine crash
+	// may lose acknowledged writes.
+	SyncNever SyncPolicy = iota
+	// SyncInterval flushes the active segment periodically, so a machine
+	// crash loses at most the writes of the last interval.
+	SyncInterval
+	// SyncAlways flushes every group of writes before acknowledging it.
+	SyncAlways
+)
+
+// DefaultSyncInterval is used by SyncInterval when no interval is given.
+const DefaultSyncInterval = time.Second
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncNever:
+		return "never"
+	case SyncInterval:
+		return "interval"
+	case SyncAlways:
+		return "always"
+	}
+	return "unknown"
+}
+
+// ParseSyncPolicy returns the policy named "never", "interval" or "always".
+func ParseSyncPolicy(name string) (SyncPolicy, bool) {
+	for _, p := range []SyncPolicy{SyncNever, SyncInterval, SyncAlways} {
+		if p.String() == name {
+			return p, true
+		}
+	}
+	return SyncNever, false
+}
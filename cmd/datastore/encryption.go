@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownKey = fmt.Errorf("record is encrypted with an unknown key")
+
+// Keyring holds the AES keys record values are encrypted with. Every
+// encrypted record names the key it was sealed with, so keys can be rotated
+// by adding a new one and keeping the old ones until merges have rewritten
+// all of their records and blobs. Record keys are stored in plain text.
+type Keyring struct {
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{aeads: make(map[uint32]cipher.AEAD)}
+}
+
+// Add registers an AES-128, AES-192 or AES-256 key under a non-zero id and
+// makes it the key new records are encrypted with.
+func (kr *Keyring) Add(id uint32, key []byte) error {
+	if id == 0 {
+		return fmt.Errorf("key id must not be zero")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	kr.aeads[id] = aead
+	kr.current = id
+	return nil
+}
+
+// ParseKeyring reads a keyring from whitespace separated "id:hex" pairs. The
+// last key listed encrypts new records. A nil keyring is returned when text
+// lists no keys.
+func ParseKeyring(text string) (*Keyring, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	kr := NewKeyring()
+	for _, field := range fields {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad encryption key %q", field)
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key id %q", parts[0])
+		}
+		key, err := hex.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key %d: %s", id, err)
+		}
+		if err := kr.Add(uint32(id), key); err != nil {
+			return nil, fmt.Errorf("bad encryption key %d: %s", id, err)
+		}
+	}
+	return kr, nil
+}
+
+// KeysEnv is the environment variable LoadKeyring reads keys from.
+const KeysEnv = "DB_ENCRYPTION_KEYS"
+
+// LoadKeyring reads a keyring from the key file, or from the KeysEnv
+// environment variable when no file is given, in the format ParseKeyring
+// takes. A nil keyring is returned when no keys are set.
+func LoadKeyring(keyFile string) (*Keyring, error) {
+	text := os.Getenv(KeysEnv)
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return ParseKeyring(text)
+}
+
+// Current returns the id of the key new records are encrypted with.
+func (kr *Keyring) Current() uint32 {
+	return kr.current
+}
+
+// seal encrypts value for the record of key with the current key. The result
+// is prefixed with the nonce.
+func (kr *Keyring) seal(key, value string) (string, uint32, error) {
+	aead := kr.aeads[kr.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", 0, err
+	}
+	return string(aead.Seal(nonce, nonce, []byte(value), []byte(key))), kr.current, nil
+}
+
+func (kr *Keyring) open(id uint32, key, value string) (string, error) {
+	var aead cipher.AEAD
+	if kr != nil {
+		aead = kr.aeads[id]
+	}
+	if aead == nil {
+		return "", fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+	if len(value) < aead.NonceSize() {
+		return "", ErrCorrupted
+	}
+	nonce := []byte(value[:aead.NonceSize()])
+	plain, err := aead.Open(nil, nonce, []byte(value[aead.NonceSize():]), []byte(key))
+	if err != nil {
+		return "", ErrCorrupted
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,172 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, ids ...uint32) *Keyring {
+	kr := NewKeyring()
+	for _, id := range ids {
+		if err := kr.Add(id, bytes.Repeat([]byte{byte(id)}, 32)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kr
+}
+
+func TestEntry_EncodeEncrypted(t *testing.T) {
+	kr := newTestKeyring(t, 1)
+	e := entry{key: "key", value: "secret value", compressed: true}
+	data, _, err := e.encode(kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("Value is stored in plain text")
+	}
+
+	var decoded entry
+	if err := decoded.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.keyID != 1 {
+		t.Errorf("Unexpected key id %d", decoded.keyID)
+	}
+	if err := decoded.decrypt(kr); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.key != "key" || decoded.value != "secret value" {
+		t.Errorf("Bad decrypted record: %+v", decoded)
+	}
+
+	if err := decoded.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.decrypt(newTestKeyring(t, 2)); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Missing key is not reported: %v", err)
+	}
+}
+
+func TestDb_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := WithCompactionPolicy(SizeTieredPolicy{MinSegments: 2, BucketHigh: 10})
+	db, err := NewDb(dir, 100, policy, WithEncryption(newTestKeyring(t, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("card", "4242-4242"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("4242")) {
+			t.Errorf("Value is stored in plain text in %s", file)
+		}
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		db, err := NewDb(dir, 100, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Get("card"); !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("Missing key is not reported: %v", err)
+		}
+	})
+
+	db, err = NewDb(dir, 100, policy, WithEncryption(newTestKeyring(t, 1, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, pair := range [][]string{{"key1", strings.Repeat("v", 100)}, {"key2", "value2"}} {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactor.waitIdle()
+	db.startCompaction()
+	db.compactor.waitIdle()
+
+	t.Run("rotation", func(t *testing.T) {
+		value, err := db.Get("card")
+		if err != nil || value != "4242-4242" {
+			t.Fatalf("Bad value for card: %s (%v)", value, err)
+		}
+		for _, sgm := range db.getSegments() {
+			pos, ok := sgm.index["card"]
+			if !ok {
+				continue
+			}
+			file, err := os.Open(sgm.outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := make([]byte, pos.size)
+			_, err = file.ReadAt(data, pos.offset)
+			file.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var e entry
+			if err := e.Decode(data); err != nil {
+				t.Fatal(err)
+			}
+			if e.keyID != 2 {
+				t.Errorf("Record is not re-encrypted by merge, key id %d", e.keyID)
+			}
+		}
+	})
+}
+
+func TestLoadKeyring(t *testing.T) {
+	defer os.Setenv(KeysEnv, os.Getenv(KeysEnv))
+	key := strings.Repeat("01", 32)
+
+	os.Setenv(KeysEnv, "1:"+key+" 2:"+key)
+	if kr, err := LoadKeyring(""); err != nil || kr == nil || kr.Current() != 2 {
+		t.Errorf("Bad keyring from %s (%v)", KeysEnv, err)
+	}
+
+	file, err := ioutil.TempFile("", "test-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString("3:" + key + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if kr, err := LoadKeyring(file.Name()); err != nil || kr == nil || kr.Current() != 3 {
+		t.Errorf("Bad keyring from the key file (%v)", err)
+	}
+
+	os.Setenv(KeysEnv, "")
+	if kr, err := LoadKeyring(""); err != nil || kr != nil {
+		t.Errorf("Expected no keyring, got %v (%v)", kr, err)
+	}
+}
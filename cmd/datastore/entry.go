@@ -2,68 +2,310 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"time"
 )
 
+// Record layout:
+//
+//	size(4) | crc(4) | type(1) | [seq(8)] | [expires(8)] | [keyID(4)] | keyLen(4) | key | valLen(4) | value
+//
+// size covers the whole record and crc is the IEEE CRC-32 of everything after
+// the crc field. The low bits of type hold the record type and the high bits
+// flag the optional fields present in the record.
+const headerSize = 9
+
+const minRecordSize = headerSize + 8
+
+// Record types. A batch record carries the number of records that follow it
+// as its value, and these records are only valid if all of them are present.
+// A blob record references a value stored in a blob file.
+const (
+	recordPut byte = iota
+	recordDelete
+	recordBatch
+	recordBlob
+)
+
+// Record flags.
+const (
+	recordTypeMask byte = 0x0f
+	// flagSeq marks records carrying the sequence number of their write.
+	flagSeq byte = 0x10
+	// flagExpires marks records carrying an expiration time in Unix
+	// nanoseconds.
+	flagExpires byte = 0x20
+	// flagCompressed marks records whose value is stored deflated.
+	flagCompressed byte = 0x40
+	// flagEncrypted marks records carrying the id of the key their value is
+	// encrypted with.
+	flagEncrypted byte = 0x80
+)
+
+var ErrCorrupted = fmt.Errorf("corrupted record")
+
 type entry struct {
 	key, value string
+	kind       byte
+	seq        uint64
+	expires    int64
+	// compressed asks for the value to be stored deflated. It is set on
+	// decoded records that were stored this way.
+	compressed bool
+	// keyID is set while the value holds the sealed value of an encrypted
+	// record.
+	keyID uint32
+}
+
+func (e *entry) deleted() bool {
+	return e.kind == recordDelete
+}
+
+// expired reports whether the record has a time to live that is over at now.
+func (e *entry) expired(now time.Time) bool {
+	return e.expires != 0 && e.expires <= now.UnixNano()
+}
+
+func batchHeader(count int, seq uint64) []byte {
+	var value [4]byte
+	binary.LittleEndian.PutUint32(value[:], uint32(count))
+	return (&entry{value: string(value[:]), kind: recordBatch, seq: seq}).Encode()
+}
+
+func (e *entry) batchCount() int {
+	if len(e.value) != 4 {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32([]byte(e.value)))
+}
+
+// compressValue deflates value. It reports false when that does not make the
+// value any shorter.
+func compressValue(value string) (string, bool) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	if _, err := io.WriteString(w, value); err != nil {
+		return value, false
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return value, false
+	}
+	return buf.String(), true
+}
+
+func decompressValue(value []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(value))
+	defer r.Close()
+	return ioutil.ReadAll(r)
 }
 
 func (e *entry) Encode() []byte {
+	record, _, _ := e.encode(nil)
+	return record
+}
+
+// encode returns the record together with the number of bytes its value
+// takes in it. The value is encrypted when a keyring is given.
+func (e *entry) encode(kr *Keyring) ([]byte, int, error) {
+	kind := e.kind
+	value := e.value
+	var keyID uint32
+	if e.compressed && value != "" {
+		if compressed, ok := compressValue(value); ok {
+			value = compressed
+			kind |= flagCompressed
+		}
+	}
+	if kr != nil && e.kind == recordPut {
+		var err error
+		if value, keyID, err = kr.seal(e.key, value); err != nil {
+			return nil, 0, err
+		}
+		kind |= flagEncrypted
+	}
 	kl := len(e.key)
-	vl := len(e.value)
-	size := kl + vl + 12
+	vl := len(value)
+	size := kl + vl + minRecordSize
+	if e.seq != 0 {
+		kind |= flagSeq
+		size += 8
+	}
+	if e.expires != 0 {
+		kind |= flagExpires
+		size += 8
+	}
+	if keyID != 0 {
+		size += 4
+	}
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
-	return res
+	res[8] = kind
+	pos := headerSize
+	if e.seq != 0 {
+		binary.LittleEndian.PutUint64(res[pos:], e.seq)
+		pos += 8
+	}
+	if e.expires != 0 {
+		binary.LittleEndian.PutUint64(res[pos:], uint64(e.expires))
+		pos += 8
+	}
+	if keyID != 0 {
+		binary.LittleEndian.PutUint32(res[pos:], keyID)
+		pos += 4
+	}
+	binary.LittleEndian.PutUint32(res[pos:], uint32(kl))
+	copy(res[pos+4:], e.key)
+	pos += kl + 4
+	binary.LittleEndian.PutUint32(res[pos:], uint32(vl))
+	copy(res[pos+4:], value)
+	binary.LittleEndian.PutUint32(res[4:], crc32.ChecksumIEEE(res[8:]))
+	return res, vl, nil
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
+// Decode parses a record. The value of an encrypted record is left sealed
+// until decrypt is called.
+func (e *entry) Decode(input []byte) error {
+	if len(input) < minRecordSize || int(binary.LittleEndian.Uint32(input)) != len(input) {
+		return ErrCorrupted
+	}
+	if binary.LittleEndian.Uint32(input[4:]) != crc32.ChecksumIEEE(input[8:]) {
+		return ErrCorrupted
+	}
+	kind := input[8] & recordTypeMask
+	flags := input[8] &^ recordTypeMask
+	if kind > recordBlob || flags&^(flagSeq|flagExpires|flagCompressed|flagEncrypted) != 0 {
+		return ErrCorrupted
+	}
+
+	pos := headerSize
+	var seq uint64
+	var expires int64
+	var keyID uint32
+	if flags&flagSeq != 0 {
+		if len(input) < pos+16 {
+			return ErrCorrupted
+		}
+		seq = binary.LittleEndian.Uint64(input[pos:])
+		pos += 8
+	}
+	if flags&flagExpires != 0 {
+		if len(input) < pos+16 {
+			return ErrCorrupted
+		}
+		expires = int64(binary.LittleEndian.Uint64(input[pos:]))
+		pos += 8
+	}
+	if flags&flagEncrypted != 0 {
+		if len(input) < pos+12 {
+			return ErrCorrupted
+		}
+		keyID = binary.LittleEndian.Uint32(input[pos:])
+		if keyID == 0 {
+			return ErrCorrupted
+		}
+		pos += 4
+	}
+
+	kl := int(binary.LittleEndian.Uint32(input[pos:]))
+	if pos+kl+8 > len(input) {
+		return ErrCorrupted
+	}
 	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
-	e.key = string(keyBuf)
+	copy(keyBuf, input[pos+4:pos+4+kl])
+	pos += kl + 4
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
+	vl := int(binary.LittleEndian.Uint32(input[pos:]))
+	if pos+4+vl != len(input) {
+		return ErrCorrupted
+	}
 	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
+	copy(valBuf, input[pos+4:])
+
+	e.key = string(keyBuf)
 	e.value = string(valBuf)
+	e.kind = kind
+	e.seq = seq
+	e.expires = expires
+	e.compressed = flags&flagCompressed != 0
+	e.keyID = keyID
+	if keyID == 0 {
+		return e.decompress()
+	}
+	return nil
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
-	if err != nil {
-		return "", err
+// decrypt opens the sealed value of an encrypted record with kr.
+func (e *entry) decrypt(kr *Keyring) error {
+	if e.keyID == 0 {
+		return nil
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
+	value, err := kr.open(e.keyID, e.key, e.value)
 	if err != nil {
-		return "", err
+		return err
 	}
+	e.value = value
+	e.keyID = 0
+	return e.decompress()
+}
 
-	header, err = in.Peek(4)
+func (e *entry) decompress() error {
+	if !e.compressed {
+		return nil
+	}
+	value, err := decompressValue([]byte(e.value))
 	if err != nil {
-		return "", err
+		return ErrCorrupted
 	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
+	e.value = string(value)
+	return nil
+}
+
+// readRecord reads a single raw record from in. A record cut short by the end
+// of the input is reported as io.ErrUnexpectedEOF.
+func readRecord(in *bufio.Reader) ([]byte, error) {
+	header, err := in.Peek(4)
 	if err != nil {
-		return "", err
+		if err == io.EOF && len(header) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(header))
+	if size < minRecordSize {
+		return nil, ErrCorrupted
 	}
 
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
+	data := make([]byte, size)
+	_, err = io.ReadFull(in, data)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	return data, nil
+}
+
+func readEntry(in *bufio.Reader) (entry, error) {
+	var e entry
+	data, err := readRecord(in)
+	if err != nil {
+		return e, err
 	}
+	err = e.Decode(data)
+	return e, err
+}
 
-	return string(data), nil
+func readValue(in *bufio.Reader) (string, error) {
+	e, err := readEntry(in)
+	if err != nil {
+		return "", err
+	}
+	return e.value, nil
 }
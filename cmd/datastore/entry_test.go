@@ -3,11 +3,12 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"strings"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -17,8 +18,19 @@ func TestEntry_Encode(t *testing.T) {
 	}
 }
 
+func TestEntry_EncodeTombstone(t *testing.T) {
+	e := entry{key: "key", kind: recordDelete}
+	var decoded entry
+	if err := decoded.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.key != "key" || !decoded.deleted() {
+		t.Error("incorrect tombstone")
+	}
+}
+
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
 	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
@@ -28,3 +40,41 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Got bat value [%s]", v)
 	}
 }
+
+func TestEntry_DecodeCorrupted(t *testing.T) {
+	data := (&entry{key: "key", value: "value"}).Encode()
+	data[len(data)-1] ^= 0xff
+
+	var e entry
+	if err := e.Decode(data); err != ErrCorrupted {
+		t.Errorf("Checksum mismatch is not detected: %v", err)
+	}
+	if err := e.Decode(data[:len(data)-1]); err != ErrCorrupted {
+		t.Errorf("Short record is not detected: %v", err)
+	}
+}
+
+func TestEntry_EncodeCompressed(t *testing.T) {
+	value := strings.Repeat(`{"field": "value"}`, 100)
+	e := entry{key: "key", value: value, compressed: true}
+	data := e.Encode()
+	if len(data) >= len(value) {
+		t.Errorf("Value is not compressed: %d bytes", len(data))
+	}
+
+	var decoded entry
+	if err := decoded.Decode(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.value != value || !decoded.compressed {
+		t.Error("incorrect compressed value")
+	}
+
+	short := entry{key: "key", value: "v", compressed: true}
+	if err := decoded.Decode(short.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.value != "v" || decoded.compressed {
+		t.Error("Value is stored compressed although it does not shrink")
+	}
+}
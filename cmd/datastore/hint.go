@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Hint file layout:
+//
+//	{ keyLen(4) | key | offset(8) | size(8) }* | maxSeq(8) | segmentSize(8) | crc(4)
+//
+// A hint mirrors the index of a sealed segment so that recovery does not have
+// to scan the segment itself. Its entries are sorted by key, which lets it
+// serve as the on-disk index of a segment with a sparse index. segmentSize
+// pins the hint to the exact segment file it was built from and crc covers
+// everything before it.
+const hintSuffix = ".hint"
+
+const hintFooterSize = 20
+
+var errBadHint = fmt.Errorf("invalid hint file")
+
+func hintPath(segmentPath string) string {
+	return segmentPath + hintSuffix
+}
+
+func isHintFile(name string) bool {
+	return strings.Contains(name, hintSuffix)
+}
+
+func (sgm *Segment) writeHint() error {
+	var buf bytes.Buffer
+	var field [8]byte
+
+	sgm.mutex.Lock()
+	keys := make([]string, 0, len(sgm.index))
+	for key := range sgm.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pos := sgm.index[key]
+		binary.LittleEndian.PutUint32(field[:], uint32(len(key)))
+		buf.Write(field[:4])
+		buf.WriteString(key)
+		binary.LittleEndian.PutUint64(field[:], uint64(pos.offset))
+		buf.Write(field[:])
+		binary.LittleEndian.PutUint64(field[:], uint64(pos.size))
+		buf.Write(field[:])
+	}
+	binary.LittleEndian.PutUint64(field[:], sgm.maxSeq)
+	buf.Write(field[:])
+	binary.LittleEndian.PutUint64(field[:], uint64(sgm.outOffset))
+	sgm.mutex.Unlock()
+
+	buf.Write(field[:])
+	binary.LittleEndian.PutUint32(field[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(field[:4])
+
+	return writeFileDurably(hintPath(sgm.outPath), buf.Bytes())
+}
+
+// loadHint fills the segment index from its hint file. The index is left
+// untouched when the hint is missing or does not match the segment file.
+func (sgm *Segment) loadHint() error {
+	data, err := ioutil.ReadFile(hintPath(sgm.outPath))
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(sgm.outPath)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < hintFooterSize {
+		return errBadHint
+	}
+	body := data[:len(data)-hintFooterSize]
+	footer := data[len(data)-hintFooterSize:]
+	maxSeq := binary.LittleEndian.Uint64(footer)
+	segmentSize := int64(binary.LittleEndian.Uint64(footer[8:]))
+	if binary.LittleEndian.Uint32(footer[16:]) != crc32.ChecksumIEEE(data[:len(data)-4]) {
+		return errBadHint
+	}
+	if segmentSize != stat.Size() {
+		return fmt.Errorf("%w: segment size %d does not match %d", errBadHint, stat.Size(), segmentSize)
+	}
+
+	index := hashIndex{}
+	for len(body) > 0 {
+		if len(body) < 4 {
+			return errBadHint
+		}
+		kl := int(binary.LittleEndian.Uint32(body))
+		if len(body) < 4+kl+16 {
+			return errBadHint
+		}
+		key := string(body[4 : 4+kl])
+		pos := recordPosition{
+			offset: int64(binary.LittleEndian.Uint64(body[4+kl:])),
+			size:   int64(binary.LittleEndian.Uint64(body[12+kl:])),
+		}
+		if pos.offset < 0 || pos.size < minRecordSize || pos.offset+pos.size > segmentSize {
+			return errBadHint
+		}
+		index[key] = pos
+		body = body[4+kl+16:]
+	}
+
+	sgm.mutex.Lock()
+	sgm.index = index
+	sgm.outOffset = segmentSize
+	sgm.maxSeq = maxSeq
+	sgm.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestHint_Recovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-hint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(pairs[0][0]); err != nil {
+		t.Fatal(err)
+	}
+	sgm := db.segments[len(db.segments)-1]
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("hint matches scan", func(t *testing.T) {
+		hinted, err := NewSegment(false, sgm.outPath, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hinted.loadHint(); err != nil {
+			t.Fatal(err)
+		}
+		scanned, err := NewSegment(false, sgm.outPath, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := scanned.recover(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(hinted.index, scanned.index) || hinted.outOffset != scanned.outOffset {
+			t.Errorf("Hint index %v differs from scanned index %v", hinted.index, scanned.index)
+		}
+	})
+
+	t.Run("corrupted hint", func(t *testing.T) {
+		data, err := ioutil.ReadFile(hintPath(sgm.outPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[0] ^= 0xff
+		if err := ioutil.WriteFile(hintPath(sgm.outPath), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		checkRecovered(t, dir)
+	})
+
+	t.Run("stale hint", func(t *testing.T) {
+		f, err := os.OpenFile(sgm.outPath, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Write((&entry{key: pairs[1][0], value: "value4"}).Encode())
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hinted, err := NewSegment(false, sgm.outPath, segmentSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := hinted.loadHint(); err == nil {
+			t.Error("Stale hint is accepted")
+		}
+	})
+}
+
+func checkRecovered(t *testing.T, dir string) {
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get(pairs[0][0]); err != ErrNotFound {
+		t.Errorf("Deleted key is found: %v", err)
+	}
+	for _, pair := range pairs[1:] {
+		value, err := db.Get(pair[0])
+		if err != nil || value != pair[1] {
+			t.Errorf("Bad value for %s: %s (%v)", pair[0], value, err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// Record is a record of a segment file as it is stored.
+type Record struct {
+	Offset int64
+	Size   int64
+	// Kind is "put", "delete", "batch" or "blob".
+	Kind string
+	Seq  uint64
+	// Expires is the expiration time of the record in Unix nanoseconds, or
+	// zero.
+	Expires int64
+	Key     string
+	// Value is left sealed when Encrypted is set.
+	Value      string
+	Compressed bool
+	Encrypted  bool
+}
+
+var recordKinds = [...]string{
+	recordPut:    "put",
+	recordDelete: "delete",
+	recordBatch:  "batch",
+	recordBlob:   "blob",
+}
+
+// ScanSegment calls fn for every record of the segment file at path in order.
+// Values of encrypted records are opened when kr holds their key. Scanning
+// stops at the first torn or corrupted record and at an incomplete batch, as
+// recovery does, and the returned tail describes the part of the file it
+// skipped. Files of the legacy layout are not read.
+func ScanSegment(path string, kr *Keyring, fn func(r Record) error) (TruncatedTail, error) {
+	tail := TruncatedTail{Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return tail, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return tail, err
+	}
+
+	in := bufio.NewReaderSize(file, bufSize)
+	tail.Offset, err = readSegmentHeader(in, stat.Size())
+	if err != nil {
+		return tail, fmt.Errorf("segment %s: %w", filepath.Base(path), err)
+	}
+	if tail.Offset == 0 {
+		tail.Dropped = stat.Size()
+		return tail, nil
+	}
+	tail.Offset, err = scanRecords(in, tail.Offset, stat.Size(), func(e entry, offset, size int64) error {
+		if kr != nil {
+			// A record sealed with an unknown key is passed on sealed.
+			e.decrypt(kr)
+		}
+		return fn(Record{
+			Offset:     offset,
+			Size:       size,
+			Kind:       recordKinds[e.kind],
+			Seq:        e.seq,
+			Expires:    e.expires,
+			Key:        e.key,
+			Value:      e.value,
+			Compressed: e.compressed,
+			Encrypted:  e.keyID != 0,
+		})
+	})
+	if err != nil {
+		return tail, err
+	}
+	tail.Dropped = stat.Size() - tail.Offset
+	return tail, nil
+}
+
+// Verify checks the database in dir and returns the problems it finds. Every
+// segment listed by the manifest has to consist of valid records only, and its
+// hint file and Bloom filter, when present, have to match its records. Files
+// of segments that are not listed are reported as well. The database should
+// not be written to meanwhile.
+func Verify(dir string) ([]error, error) {
+	names, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []error
+	for _, name := range names {
+		problems = append(problems, verifySegment(filepath.Join(dir, name))...)
+	}
+	stray, err := strayFiles(dir, names)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range stray {
+		problems = append(problems, fmt.Errorf("%s: not part of a live segment", name))
+	}
+	return problems, nil
+}
+
+func verifySegment(path string) []error {
+	name := filepath.Base(path)
+	if _, err := os.Stat(path); err != nil {
+		return []error{fmt.Errorf("segment %s: %w", name, err)}
+	}
+
+	var problems []error
+	scanned, err := NewSegment(false, path, 0)
+	if err != nil {
+		return []error{fmt.Errorf("segment %s: %w", name, err)}
+	}
+	defer scanned.closeReader()
+	dropped, err := scanned.scan()
+	if err != nil {
+		return []error{fmt.Errorf("segment %s: %w", name, err)}
+	}
+	if dropped > 0 {
+		problems = append(problems, fmt.Errorf("segment %s: %d bytes of torn or corrupted records at offset %d", name, dropped, scanned.outOffset))
+	}
+
+	hinted, err := NewSegment(false, path, 0)
+	if err != nil {
+		return append(problems, fmt.Errorf("segment %s: %w", name, err))
+	}
+	defer hinted.closeReader()
+	if err := hinted.loadHint(); err != nil {
+		if !os.IsNotExist(err) {
+			problems = append(problems, fmt.Errorf("segment %s: hint file: %w", name, err))
+		}
+	} else if !reflect.DeepEqual(hinted.index, scanned.index) || hinted.maxSeq != scanned.maxSeq {
+		problems = append(problems, fmt.Errorf("segment %s: hint file does not match the records", name))
+	}
+
+	if err := scanned.loadBloom(); err != nil {
+		if !os.IsNotExist(err) {
+			problems = append(problems, fmt.Errorf("segment %s: bloom filter: %w", name, err))
+		}
+	} else {
+		for key := range scanned.index {
+			if !scanned.bloom.mayContain(key) {
+				problems = append(problems, fmt.Errorf("segment %s: bloom filter misses key %q", name, key))
+				break
+			}
+		}
+	}
+	return problems
+}
+
+// Repair cuts the torn or corrupted tails off the segments of the database in
+// dir, rewrites their hint files and Bloom filters, and removes the files of
+// segments that are not live. It returns the tails that were cut off. The
+// database must not be open.
+func Repair(dir string) ([]TruncatedTail, error) {
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	names, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var tails []TruncatedTail
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			return tails, err
+		}
+		sgm, err := NewSegment(false, path, 0)
+		if err != nil {
+			return tails, err
+		}
+		dropped, err := sgm.scan()
+		if err == nil {
+			err = sgm.truncate(dropped)
+		}
+		if err == nil && dropped > 0 {
+			tails = append(tails, TruncatedTail{Path: path, Offset: sgm.outOffset, Dropped: dropped})
+		}
+		if err == nil {
+			err = sgm.writeHint()
+		}
+		if err == nil {
+			err = sgm.buildBloom()
+		}
+		sgm.closeReader()
+		if err != nil {
+			return tails, fmt.Errorf("segment %s: %w", name, err)
+		}
+	}
+
+	stray, err := strayFiles(dir, names)
+	if err != nil {
+		return tails, err
+	}
+	for _, name := range stray {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return tails, err
+		}
+	}
+	return tails, nil
+}
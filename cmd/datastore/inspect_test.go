@@ -0,0 +1,207 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-scan-segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyring := newTestKeyring(t, 1)
+	db, err := NewDb(dir, segmentSize, WithEncryption(keyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(pairs[0][0]); err != nil {
+		t.Fatal(err)
+	}
+	path := db.getSegments()[len(db.getSegments())-1].outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []Record
+	tail, err := ScanSegment(path, keyring, func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tail.Dropped != 0 || len(records) != len(pairs)+1 {
+		t.Fatalf("Scanned %d records up to %+v", len(records), tail)
+	}
+	for i, pair := range pairs {
+		r := records[i]
+		if r.Kind != "put" || r.Key != pair[0] || r.Value != pair[1] || r.Encrypted || r.Seq != uint64(i+1) {
+			t.Errorf("Bad record %d: %+v", i, r)
+		}
+	}
+	if last := records[len(pairs)]; last.Kind != "delete" || last.Key != pairs[0][0] {
+		t.Errorf("Bad tombstone: %+v", last)
+	}
+
+	// Without the keyring values stay sealed.
+	_, err = ScanSegment(path, nil, func(r Record) error {
+		if r.Kind == "put" && (!r.Encrypted || r.Value == pairs[0][1]) {
+			t.Errorf("Record is not sealed: %+v", r)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-verify-repair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := db.getSegments()[len(db.getSegments())-1].outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems, err := Verify(dir); err != nil || len(problems) != 0 {
+		t.Fatalf("Healthy database has problems: %v (%v)", problems, err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := int64(len(data))
+	data = append(data, 0xde, 0xad, 0xbe, 0xef, 0x00)
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stray := filepath.Join(dir, mergedName(filepath.Base(path)))
+	if err := ioutil.WriteFile(stray, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The torn tail breaks the hint file as well.
+	problems, err := Verify(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 3 {
+		t.Errorf("Expected 3 problems, got %v", problems)
+	}
+
+	tails, err := Repair(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tails) != 1 || tails[0].Path != path || tails[0].Offset != valid || tails[0].Dropped != 5 {
+		t.Errorf("Bad repaired tails: %+v", tails)
+	}
+	if problems, err := Verify(dir); err != nil || len(problems) != 0 {
+		t.Errorf("Repaired database has problems: %v (%v)", problems, err)
+	}
+}
+
+func TestDb_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The trigger keeps the worker from merging anything by itself.
+	db, err := NewDb(dir, 60, WithCompactionTrigger(CompactionTrigger{MinSegments: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if err := db.Put(createUniqueString(i%3), createUniqueString(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if sgms := db.getSegments(); len(sgms) != 2 {
+		t.Errorf("Expected a merged and an active segment, got %v", segmentFileNames(db))
+	}
+	for i := 7; i < 10; i++ {
+		if value, err := db.Get(createUniqueString(i % 3)); err != nil || value != createUniqueString(i) {
+			t.Errorf("Bad value %q (%v)", value, err)
+		}
+	}
+}
+
+func TestScanSegment_TornBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-scan-torn-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key0", "value0"); err != nil {
+		t.Fatal(err)
+	}
+	var b WriteBatch
+	for _, pair := range pairs {
+		b.Put(pair[0], pair[1])
+	}
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	sgms := db.getSegments()
+	path := sgms[len(sgms)-1].outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, stat.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []Record
+	tail, err := ScanSegment(path, nil, func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Key != "key0" {
+		t.Errorf("Records of a torn batch are scanned: %+v", records)
+	}
+	if end := records[0].Offset + records[0].Size; tail.Offset != end || tail.Dropped != stat.Size()-1-end {
+		t.Errorf("Bad tail %+v", tail)
+	}
+}
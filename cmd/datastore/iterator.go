@@ -0,0 +1,184 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// keySet is an ordered set of keys that may include deleted ones.
+type keySet interface {
+	// Next returns the smallest key greater than key, or equal to it when
+	// inclusive is set.
+	Next(key string, inclusive bool) (string, bool, error)
+}
+
+// mergedKeys is the union of several key sets.
+type mergedKeys []keySet
+
+func (mk mergedKeys) Next(key string, inclusive bool) (string, bool, error) {
+	next, found := "", false
+	for _, keys := range mk {
+		k, ok, err := keys.Next(key, inclusive)
+		if err != nil {
+			return "", false, err
+		}
+		if ok && (!found || k < next) {
+			next, found = k, true
+		}
+	}
+	return next, found, nil
+}
+
+// dbKeys is the key set of a Db. Keys of segments with an in-memory index are
+// kept in the skip list, while the keys of the other segments are read from
+// their sparse indexes.
+type dbKeys struct {
+	db *Db
+}
+
+func (dk dbKeys) Next(key string, inclusive bool) (string, bool, error) {
+	sgms := dk.db.acquireSegments()
+	defer releaseSegments(sgms)
+
+	sets := mergedKeys{skipListKeys{dk.db.keys}}
+	for _, sgm := range sgms {
+		sgm.mutex.Lock()
+		if sgm.index == nil {
+			sets = append(sets, sgm.sparse)
+		}
+		sgm.mutex.Unlock()
+	}
+	return sets.Next(key, inclusive)
+}
+
+type skipListKeys struct {
+	*skipList
+}
+
+func (sk skipListKeys) Next(key string, inclusive bool) (string, bool, error) {
+	k, ok := sk.skipList.Next(key, inclusive)
+	return k, ok, nil
+}
+
+// Iterator walks live keys in lexical order together with their newest
+// values. An iterator returned by Db.Scan reads the database lazily, so keys
+// written or deleted during the iteration may or may not be seen. An Iterator
+// is not safe for concurrent use.
+type Iterator struct {
+	keys  keySet
+	get   func(key string) (string, error)
+	end   string
+	limit int
+	count int
+
+	key, value string
+	started    bool
+	done       bool
+	err        error
+}
+
+// Scan returns an iterator over the live keys in [start, end). An empty end
+// leaves the range unbounded and a non-positive limit returns every key.
+func (db *Db) Scan(start, end string, limit int) *Iterator {
+	return &Iterator{
+		keys:  dbKeys{db},
+		get:   db.Get,
+		end:   end,
+		limit: limit,
+		key:   start,
+	}
+}
+
+// Next advances the iterator and reports whether a key is available.
+func (it *Iterator) Next() bool {
+	for !it.done {
+		if it.limit > 0 && it.count >= it.limit {
+			it.done = true
+			break
+		}
+
+		key, ok, err := it.keys.Next(it.key, !it.started)
+		it.started = true
+		if err != nil {
+			it.err = err
+			it.done = true
+			break
+		}
+		if !ok || it.end != "" && key >= it.end {
+			it.done = true
+			break
+		}
+		it.key = key
+
+		value, err := it.get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			it.done = true
+			break
+		}
+		it.value = value
+		it.count++
+		return true
+	}
+	return false
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+var ErrBadCursor = fmt.Errorf("malformed cursor")
+
+// Iterate calls fn for every live key starting with prefix in lexical order.
+// Returning false from fn stops the iteration after that key. The returned
+// cursor resumes the iteration right after the last visited key when passed
+// back to Iterate, and is empty once every key has been visited.
+func (db *Db) Iterate(prefix, cursor string, fn func(key, value string) bool) (string, error) {
+	return iterate(db.Scan, prefix, cursor, fn)
+}
+
+func iterate(scan func(start, end string, limit int) *Iterator, prefix, cursor string, fn func(key, value string) bool) (string, error) {
+	start := prefix
+	if cursor != "" {
+		last, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return "", ErrBadCursor
+		}
+		if after := string(last) + "\x00"; after > start {
+			start = after
+		}
+	}
+
+	it := scan(start, prefixEnd(prefix), 0)
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			return base64.RawURLEncoding.EncodeToString([]byte(it.Key())), nil
+		}
+	}
+	return "", it.Err()
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or an empty string when there is no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
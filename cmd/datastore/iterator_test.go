@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, pair := range [][]string{
+		{"d", "old"}, {"b", "2"}, {"a", "1"}, {"e", "5"}, {"c", "3"}, {"d", "4"}, {"f", "6"},
+	} {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func(db *Db, start, end string, limit int) []string {
+		var res []string
+		it := db.Scan(start, end, limit)
+		for it.Next() {
+			res = append(res, it.Key()+"="+it.Value())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, tc := range []struct {
+		start, end string
+		limit      int
+		expected   []string
+	}{
+		{"", "", 0, []string{"a=1", "b=2", "d=4", "e=5", "f=6"}},
+		{"b", "e", 0, []string{"b=2", "d=4"}},
+		{"bb", "", 2, []string{"d=4", "e=5"}},
+		{"g", "", 0, nil},
+	} {
+		if res := scan(db, tc.start, tc.end, tc.limit); !equalStrings(res, tc.expected) {
+			t.Errorf("Bad scan [%q, %q) limit %d: expected %v, got %v", tc.start, tc.end, tc.limit, tc.expected, res)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if res := scan(db, "", "", 0); !equalStrings(res, []string{"a=1", "b=2", "d=4", "e=5", "f=6"}) {
+		t.Errorf("Bad scan after recovery: %v", res)
+	}
+}
+
+func TestDb_Iterate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-iterate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"user:1:name", "user:2:name", "user:1:profile", "user", "users:1", "user:3:name"} {
+		if err := db.Put(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("user:2:name"); err != nil {
+		t.Fatal(err)
+	}
+
+	var pages [][]string
+	cursor := ""
+	for {
+		var page []string
+		cursor, err = db.Iterate("user:", cursor, func(key, value string) bool {
+			page = append(page, key)
+			return len(page) < 2
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, page)
+		if cursor == "" {
+			break
+		}
+	}
+
+	expected := [][]string{{"user:1:name", "user:1:profile"}, {"user:3:name"}}
+	if len(pages) != len(expected) {
+		t.Fatalf("Bad pages: %v", pages)
+	}
+	for i := range pages {
+		if !equalStrings(pages[i], expected[i]) {
+			t.Errorf("Bad page %d: expected %v, got %v", i, expected[i], pages[i])
+		}
+	}
+
+	if _, err := db.Iterate("user:", "not base64!", func(string, string) bool { return true }); err != ErrBadCursor {
+		t.Errorf("Bad cursor is accepted: %v", err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, end := range map[string]string{
+		"":         "",
+		"abc":      "abd",
+		"ab\xff":   "ac",
+		"\xff\xff": "",
+	} {
+		if res := prefixEnd(prefix); res != end {
+			t.Errorf("Bad end for %q: expected %q, got %q", prefix, end, res)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Legacy record layout:
+//
+//	size(4) | keyLen(4) | key | valLen(4) | value
+//
+// Segments written before segment headers were introduced consist of such
+// records, without checksums, sequence numbers or tombstones: a deleted key
+// holds legacyMarker as its value. The oldest data of such a directory is kept
+// in legacyMergedName, the file merges used to write to.
+const (
+	legacyMergedName = "system-segment"
+	legacyMarker     = "marker"
+	legacyHeaderSize = 8
+)
+
+// upgradedMergedName replaces legacyMergedName. It sorts before the names of
+// all other segments, which are creation times.
+const upgradedMergedName = "0"
+
+// isLegacySegment reports whether the segment file at path has the legacy
+// layout.
+func isLegacySegment(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	_, err = readSegmentHeader(bufio.NewReader(file), stat.Size())
+	if err == errLegacySegment {
+		return true, nil
+	}
+	return false, nil
+}
+
+// upgradeSegment rewrites the legacy segment name of dir in the current layout
+// and returns the name of the new file. Its records get sequence numbers
+// following *seq in the order they were written. A legacy segment is only
+// replaced once all of it was read: as its records carry no checksums, a
+// damaged one makes the upgrade fail instead of being cut off.
+func upgradeSegment(dir, name string, seq *uint64) (string, error) {
+	path := filepath.Join(dir, name)
+	upgradedName := name
+	if name == legacyMergedName {
+		upgradedName = upgradedMergedName
+	}
+	upgradedPath := filepath.Join(dir, upgradedName)
+	tmpPath := upgradedPath + ".tmp"
+
+	input, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", err
+	}
+	err = convertLegacyRecords(input, output, seq)
+	if err == nil {
+		err = output.Sync()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, upgradedPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("upgrading segment %s: %w", name, err)
+	}
+	if upgradedName != name {
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	}
+	return upgradedName, syncDir(dir)
+}
+
+// maxSegmentSeq returns the highest sequence number of the records in the
+// segment file at path.
+func maxSegmentSeq(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	in := bufio.NewReaderSize(file, bufSize)
+	offset, err := readSegmentHeader(in, stat.Size())
+	if err != nil || offset == 0 {
+		return 0, err
+	}
+	var max uint64
+	_, err = scanRecords(in, offset, stat.Size(), func(e entry, offset, size int64) error {
+		if e.seq > max {
+			max = e.seq
+		}
+		return nil
+	})
+	return max, err
+}
+
+func convertLegacyRecords(r io.Reader, w io.Writer, seq *uint64) error {
+	in := bufio.NewReaderSize(r, bufSize)
+	out := bufio.NewWriterSize(w, bufSize)
+	if _, err := out.Write(segmentHeader()); err != nil {
+		return err
+	}
+	for offset := int64(0); ; {
+		e, size, err := readLegacyRecord(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("legacy record at offset %d: %w", offset, err)
+		}
+		*seq++
+		e.seq = *seq
+		if _, err := out.Write(e.Encode()); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return out.Flush()
+}
+
+func readLegacyRecord(in *bufio.Reader) (entry, int64, error) {
+	header, err := in.Peek(legacyHeaderSize)
+	if err == io.EOF && len(header) == 0 {
+		return entry{}, 0, io.EOF
+	}
+	if err == io.EOF {
+		return entry{}, 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return entry{}, 0, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header))
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	if size < legacyHeaderSize+4 || kl > size-legacyHeaderSize-4 {
+		return entry{}, 0, ErrCorrupted
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(in, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return entry{}, 0, err
+	}
+	vl := int64(binary.LittleEndian.Uint32(data[legacyHeaderSize+kl:]))
+	if legacyHeaderSize+kl+4+vl != size {
+		return entry{}, 0, ErrCorrupted
+	}
+	e := entry{
+		key:   string(data[legacyHeaderSize : legacyHeaderSize+kl]),
+		value: string(data[legacyHeaderSize+kl+4:]),
+		kind:  recordPut,
+	}
+	if e.value == legacyMarker {
+		e = entry{key: e.key, kind: recordDelete}
+	}
+	return e, size, nil
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyRecords encodes pairs in the legacy layout.
+func legacyRecords(pairs ...[]string) []byte {
+	var data []byte
+	for _, pair := range pairs {
+		kl, vl := len(pair[0]), len(pair[1])
+		record := make([]byte, legacyHeaderSize+kl+4+vl)
+		binary.LittleEndian.PutUint32(record, uint32(len(record)))
+		binary.LittleEndian.PutUint32(record[4:], uint32(kl))
+		copy(record[legacyHeaderSize:], pair[0])
+		binary.LittleEndian.PutUint32(record[legacyHeaderSize+kl:], uint32(vl))
+		copy(record[legacyHeaderSize+kl+4:], pair[1])
+		data = append(data, record...)
+	}
+	return data
+}
+
+func TestDb_UpgradeLegacySegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		legacyMergedName: legacyRecords([]string{"merged", "old"}, []string{"deleted", "value"}),
+		"100":            legacyRecords([]string{"merged", "new"}, []string{"deleted", legacyMarker}),
+		"200":            legacyRecords([]string{"latest", "value"}),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Merges would rename the upgraded segments.
+	noMerges := WithCompactionTrigger(CompactionTrigger{MinSegments: 100})
+	db, err := NewDb(dir, segmentSize, noMerges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(t *testing.T, db *Db) {
+		for key, expected := range map[string]string{"merged": "new", "latest": "value"} {
+			if value, err := db.Get(key); err != nil || value != expected {
+				t.Errorf("Bad value %q for %s (%v)", value, key, err)
+			}
+		}
+		if _, err := db.Get("deleted"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+		if _, version, err := db.GetVersion("latest"); err != nil || version != 5 {
+			t.Errorf("Bad version %d (%v)", version, err)
+		}
+	}
+	check(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := segmentFileNames(db)
+	if len(names) < 3 || !equalStrings(names[:3], []string{upgradedMergedName, "100", "200"}) {
+		t.Errorf("Bad upgraded segments: %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(dir, legacyMergedName)); !os.IsNotExist(err) {
+		t.Errorf("Legacy merge output is kept: %v", err)
+	}
+
+	db, err = NewDb(dir, segmentSize, noMerges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(t, db)
+}
+
+func TestDb_DamagedLegacySegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-legacy-damaged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := legacyRecords(pairs...)
+	data = data[:len(data)-2]
+	path := filepath.Join(dir, "100")
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDb(dir, segmentSize); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected the upgrade to fail, got %v", err)
+	}
+	if stored, err := ioutil.ReadFile(path); err != nil || string(stored) != string(data) {
+		t.Errorf("Damaged legacy segment is modified (%v)", err)
+	}
+}
+
+func TestDb_ResumeLegacyUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-legacy-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"100": legacyRecords([]string{"old", "value"}, []string{"key", "old"}),
+		"200": legacyRecords([]string{"key", "new"}),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A crash came after the first segment was upgraded.
+	var seq uint64
+	if _, err := upgradeSegment(dir, "100", &seq); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDb(dir, segmentSize, WithCompactionTrigger(CompactionTrigger{MinSegments: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	value, version, err := db.GetVersion("key")
+	if err != nil || value != "new" || version <= seq {
+		t.Errorf("Bad value %q of version %d after versions up to %d (%v)", value, version, seq, err)
+	}
+}
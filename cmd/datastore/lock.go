@@ -0,0 +1,50 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by NewDb when another process has the directory open.
+var ErrLocked = fmt.Errorf("database directory is locked by another process")
+
+const lockFileName = "LOCK"
+
+// dirLock is an exclusive lock on a database directory held through its lock
+// file.
+type dirLock struct {
+	file *os.File
+}
+
+// lockDir takes the lock of dir without waiting for it.
+func lockDir(dir string) (*dirLock, error) {
+	path := filepath.Join(dir, lockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if err == errWouldBlock {
+			return nil, fmt.Errorf("%s: %w", dir, ErrLocked)
+		}
+		return nil, err
+	}
+	return &dirLock{file: file}, nil
+}
+
+// release unlocks the directory. The lock file is left in place, as removing
+// it could race with another process locking it.
+func (l *dirLock) release() error {
+	if l.file == nil {
+		return nil
+	}
+	file := l.file
+	l.file = nil
+	if err := unlockFile(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
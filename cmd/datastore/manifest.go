@@ -0,0 +1,273 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Manifest file layout:
+//
+//	version(4) | generation(8) | count(4) | { nameLen(4) | name }* | crc(4)
+//
+// The manifest lists the live segments of the database from oldest to newest.
+// It is replaced atomically whenever the list changes, so a merge only takes
+// effect once the manifest naming its result is in place, and files of
+// segments it does not list are leftovers of an interrupted merge or of a
+// segment that was being created. generation grows with every replacement and
+// crc covers everything before it.
+const manifestFileName = "MANIFEST"
+
+const manifestVersion = 1
+
+var errBadManifest = fmt.Errorf("invalid manifest file")
+
+type manifest struct {
+	generation uint64
+	segments   []string
+}
+
+func (m *manifest) encode() []byte {
+	var buf bytes.Buffer
+	var field [8]byte
+	binary.LittleEndian.PutUint32(field[:], manifestVersion)
+	buf.Write(field[:4])
+	binary.LittleEndian.PutUint64(field[:], m.generation)
+	buf.Write(field[:])
+	binary.LittleEndian.PutUint32(field[:], uint32(len(m.segments)))
+	buf.Write(field[:4])
+	for _, name := range m.segments {
+		binary.LittleEndian.PutUint32(field[:], uint32(len(name)))
+		buf.Write(field[:4])
+		buf.WriteString(name)
+	}
+	binary.LittleEndian.PutUint32(field[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(field[:4])
+	return buf.Bytes()
+}
+
+func decodeManifest(data []byte) (*manifest, error) {
+	if len(data) < 20 {
+		return nil, errBadManifest
+	}
+	body := data[:len(data)-4]
+	if binary.LittleEndian.Uint32(data[len(body):]) != crc32.ChecksumIEEE(body) {
+		return nil, errBadManifest
+	}
+	if version := binary.LittleEndian.Uint32(body); version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", version)
+	}
+	m := &manifest{generation: binary.LittleEndian.Uint64(body[4:])}
+	count := int(binary.LittleEndian.Uint32(body[12:]))
+	pos := 16
+	for i := 0; i < count; i++ {
+		if pos+4 > len(body) {
+			return nil, errBadManifest
+		}
+		l := int(binary.LittleEndian.Uint32(body[pos:]))
+		pos += 4
+		if pos+l > len(body) {
+			return nil, errBadManifest
+		}
+		m.segments = append(m.segments, string(body[pos:pos+l]))
+		pos += l
+	}
+	if pos != len(body) {
+		return nil, errBadManifest
+	}
+	return m, nil
+}
+
+func readManifest(dir string) (*manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	return decodeManifest(data)
+}
+
+// writeManifest replaces the manifest of dir with m once m is on stable
+// storage.
+func writeManifest(dir string, m *manifest) error {
+	return writeFileDurably(filepath.Join(dir, manifestFileName), m.encode())
+}
+
+// writeFileDurably replaces the file at path with data once data is on stable
+// storage, and makes the replacement durable as well.
+func writeFileDurably(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of dir, which makes a rename in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !os.IsPermission(err) {
+		// Some platforms cannot sync directories at all.
+		log.Printf("Cannot sync %s: %s", dir, err)
+	}
+	return nil
+}
+
+// commitSegments replaces the segments with the result of update, recording
+// the new list in the manifest first. The list stays as it is when the
+// manifest cannot be written. New segments, with their hint files and Bloom
+// filters, have to be on stable storage already, as the manifest may be the
+// last thing that references the data they replace.
+func (db *Db) commitSegments(update func(segments []*Segment) []*Segment) error {
+	db.manifestMutex.Lock()
+	defer db.manifestMutex.Unlock()
+
+	segments := update(db.getSegments())
+	m := &manifest{generation: db.generation + 1}
+	for _, sgm := range segments {
+		m.segments = append(m.segments, filepath.Base(sgm.outPath))
+	}
+	if err := writeManifest(db.dir, m); err != nil {
+		return err
+	}
+	db.generation = m.generation
+
+	db.mutex.Lock()
+	db.segments = segments
+	db.mutex.Unlock()
+	return nil
+}
+
+// segmentNames returns the live segments in order.
+func (db *Db) segmentNames() ([]string, error) {
+	names, generation, err := listSegments(db.dir)
+	db.generation = generation
+	return names, err
+}
+
+// ListSegments returns the names of the live segment files of the database in
+// dir from oldest to newest.
+func ListSegments(dir string) ([]string, error) {
+	names, _, err := listSegments(dir)
+	return names, err
+}
+
+// listSegments returns the live segments of dir in order together with the
+// generation of the manifest. Without a manifest, which is the case for
+// directories written before it was introduced, they are found by listing the
+// directory, and the output of a legacy merge is the oldest of them.
+func listSegments(dir string) ([]string, uint64, error) {
+	m, err := readManifest(dir)
+	if err == nil {
+		return m.segments, m.generation, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var segments []string
+	keys := map[string][]int64{}
+	legacyMerged := false
+	for _, file := range files {
+		if file.IsDir() || !isSegmentFile(file.Name()) {
+			continue
+		}
+		if file.Name() == legacyMergedName {
+			legacyMerged = true
+			continue
+		}
+		key, err := segmentNameKey(file.Name())
+		if err != nil {
+			log.Printf("Ignoring %s: %s", file.Name(), err)
+			continue
+		}
+		segments = append(segments, file.Name())
+		keys[file.Name()] = key
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		return lessSegmentKey(keys[segments[i]], keys[segments[j]])
+	})
+	if legacyMerged {
+		segments = append([]string{legacyMergedName}, segments...)
+	}
+	return segments, 0, nil
+}
+
+func isSegmentFile(name string) bool {
+	return name != lockFileName && !strings.HasPrefix(name, manifestFileName) &&
+		!isHintFile(name) && !isBloomFile(name)
+}
+
+// removeStrayFiles removes the segment files of dir, with their hints and
+// bloom filters, that belong to none of the live segments.
+func (db *Db) removeStrayFiles(live []string) error {
+	stray, err := strayFiles(db.dir, live)
+	if err != nil {
+		return err
+	}
+	for _, name := range stray {
+		log.Printf("Removing stray file %s", name)
+		if err := os.Remove(filepath.Join(db.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// strayFiles returns the files of dir that belong to segments other than the
+// live ones.
+func strayFiles(dir string, live []string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	isLive := make(map[string]bool, len(live))
+	for _, name := range live {
+		isLive[name] = true
+	}
+	var stray []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || name == lockFileName || strings.HasPrefix(name, manifestFileName) {
+			continue
+		}
+		owner := strings.SplitN(name, ".", 2)[0]
+		if isLive[owner] {
+			continue
+		}
+		if _, err := segmentNameKey(owner); err != nil {
+			continue
+		}
+		stray = append(stray, name)
+	}
+	return stray, nil
+}
@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifest_Encode(t *testing.T) {
+	m := &manifest{generation: 7, segments: []string{"1", "2-1", "3"}}
+	data := m.encode()
+	decoded, err := decodeManifest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, m) {
+		t.Errorf("Bad decoded manifest: %v", decoded)
+	}
+
+	data[len(data)-5] ^= 0xff
+	if _, err := decodeManifest(data); err != errBadManifest {
+		t.Errorf("Expected errBadManifest, got %v", err)
+	}
+}
+
+func segmentFileNames(db *Db) []string {
+	var names []string
+	for _, sgm := range db.getSegments() {
+		names = append(names, filepath.Base(sgm.outPath))
+	}
+	return names
+}
+
+func TestDb_Manifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := db.Put("key", createUniqueString(i)+createUniqueString(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := segmentFileNames(db)
+	if !equalStrings(m.segments, names) {
+		t.Fatalf("Manifest lists %v instead of %v", m.segments, names)
+	}
+
+	t.Run("interrupted merge", func(t *testing.T) {
+		// A merge that crashed before replacing the manifest leaves its
+		// output behind.
+		stray := filepath.Join(dir, mergedName(names[0]))
+		data, err := ioutil.ReadFile(filepath.Join(dir, names[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{stray, hintPath(stray)} {
+			if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		other := filepath.Join(dir, "notes.txt")
+		if err := ioutil.WriteFile(other, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := NewDb(dir, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, path := range []string{stray, hintPath(stray)} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("Stray file %s is kept", path)
+			}
+		}
+		if _, err := os.Stat(other); err != nil {
+			t.Errorf("Unrelated file is removed: %s", err)
+		}
+		if !equalStrings(segmentFileNames(db)[:len(names)], names) {
+			t.Errorf("Bad segments: expected %v, got %v", names, segmentFileNames(db))
+		}
+		if value, err := db.Get("key"); err != nil || value != createUniqueString(3)+createUniqueString(3) {
+			t.Errorf("Bad value %q (%v)", value, err)
+		}
+	})
+
+	t.Run("directory without manifest", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(dir, manifestFileName)); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if value, err := db.Get("key"); err != nil || value != createUniqueString(3)+createUniqueString(3) {
+			t.Errorf("Bad value %q (%v)", value, err)
+		}
+		m, err := readManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(m.segments, segmentFileNames(db)) {
+			t.Errorf("Manifest lists %v instead of %v", m.segments, segmentFileNames(db))
+		}
+	})
+}
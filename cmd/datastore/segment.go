@@ -2,31 +2,128 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Segment file layout:
+//
+//	magic(8) | version(4) | { record }*
+//
+// Files written before the header was introduced hold records of the legacy
+// layout only, which the database converts when it opens them.
+const segmentMagic = "\x89DSSEG\r\n"
+
+const segmentVersion = 1
+
+const segmentHeaderSize = len(segmentMagic) + 4
+
+var errLegacySegment = fmt.Errorf("segment file has the legacy layout")
+
+func segmentHeader() []byte {
+	header := make([]byte, segmentHeaderSize)
+	copy(header, segmentMagic)
+	binary.LittleEndian.PutUint32(header[len(segmentMagic):], segmentVersion)
+	return header
+}
+
+// readSegmentHeader consumes the header of a segment file of the given size
+// and returns the offset of its first record. A file that is empty or holds a
+// part of the header only, as a crash right after creating it leaves, has no
+// records and gives 0.
+func readSegmentHeader(in *bufio.Reader, size int64) (int64, error) {
+	header, err := in.Peek(segmentHeaderSize)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if len(header) < segmentHeaderSize {
+		if int64(len(header)) == size && bytes.Equal(header, segmentHeader()[:len(header)]) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unrecognized segment header")
+	}
+	if string(header[:len(segmentMagic)]) != segmentMagic {
+		return 0, errLegacySegment
+	}
+	if version := binary.LittleEndian.Uint32(header[len(segmentMagic):]); version != segmentVersion {
+		return 0, fmt.Errorf("unsupported segment version %d", version)
+	}
+	_, err = in.Discard(segmentHeaderSize)
+	return int64(segmentHeaderSize), err
+}
+
 type ChannelData struct {
-	data         entry
+	data entry
+	// batch, when set, is written instead of data as a single atomic batch.
+	batch        []entry
 	errorChannel chan error
 }
 
 type Segment struct {
-	out       *os.File
+	out *os.File
+	// in is the read handle shared by all lookups, which use positional
+	// reads and so can run concurrently.
+	in        *os.File
+	inClose   sync.Once
 	outPath   string
 	outOffset int64
 	index     hashIndex
+	// sparse replaces index for sealed segments whose keys are not kept in
+	// memory.
+	sparse *sparseIndex
+	// bloom, set once the segment is sealed, holds every key of the segment.
+	bloom *bloomFilter
+	// filesPending is set by seal until writeIndexFiles writes the hint file
+	// and the Bloom filter of the segment.
+	filesPending bool
+	// maxSeq is the highest sequence number written to the segment.
+	maxSeq uint64
+	// liveSize is the number of bytes taken by records that are still the
+	// newest of their keys. Writes keep it up to date in active segments,
+	// while the compaction pass measures it for sealed ones, and it is
+	// negative until then.
+	liveSize int64
 
 	size int64
+	segmentConfig
 
 	mutex          sync.Mutex
 	writingChannel chan ChannelData
+	writingDone    chan struct{}
+
+	// refs counts readers using the segment. The files of a retired segment
+	// are removed once the last of them is gone.
+	refs    int32
+	retired int32
+	removed int32
+}
+
+// segmentConfig holds the settings a Db shares with its segments.
+type segmentConfig struct {
+	// values, when set, counts the bytes of values written to the segment.
+	values *valueStats
+	// keyring, when set, encrypts the values written to the segment and
+	// decrypts the values read from it.
+	keyring *Keyring
+
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
 }
 
 func NewSegment(isActive bool, outPath string, size int64) (*Segment, error) {
+	return openSegment(isActive, outPath, size, segmentConfig{})
+}
+
+func openSegment(isActive bool, outPath string, size int64, config segmentConfig) (*Segment, error) {
 	f, err := os.OpenFile(outPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 
 	out := f
@@ -41,111 +138,457 @@ func NewSegment(isActive bool, outPath string, size int64) (*Segment, error) {
 		out.Close()
 	}
 
+	in, err := os.Open(outPath)
+	if err != nil {
+		if out != nil {
+			out.Close()
+		}
+		return nil, err
+	}
+
 	smg := &Segment{
 		outPath:   outPath,
 		outOffset: 0,
 		size:      size,
-		index:     map[string]int64{},
+		index:     hashIndex{},
+		liveSize:  -1,
 		out:       out,
+		in:        in,
+
+		segmentConfig: config,
 	}
 
 	if isActive {
-		smg.writingChannel = make(chan ChannelData)
+		if err := smg.writeHeader(); err != nil {
+			smg.closeReader()
+			out.Close()
+			return nil, err
+		}
+		smg.liveSize = smg.outOffset
+		smg.writingChannel = make(chan ChannelData, maxGroupSize)
+		smg.writingDone = make(chan struct{})
 		go smg.writingLoop()
 	}
 
 	return smg, nil
 }
 
+// writeHeader starts a new active segment file with the segment header.
+func (sgm *Segment) writeHeader() error {
+	stat, err := sgm.out.Stat()
+	if err != nil || stat.Size() != 0 {
+		return err
+	}
+	if _, err := sgm.out.Write(segmentHeader()); err != nil {
+		return err
+	}
+	sgm.outOffset = int64(segmentHeaderSize)
+	return nil
+}
+
 const bufSize = 8192
 
-func (sgm *Segment) recover() error {
+// recover rebuilds the segment index from its file. A torn or corrupted tail
+// left behind by a crash is cut off at the last valid record, down to the
+// segment header when the first record is damaged, and the number of dropped
+// bytes is returned. Files without a segment header are never cut.
+func (sgm *Segment) recover() (int64, error) {
+	dropped, err := sgm.scan()
+	if err != nil {
+		return 0, err
+	}
+	return dropped, sgm.truncate(dropped)
+}
+
+// truncate cuts off the dropped bytes after the last valid record found by
+// scan.
+func (sgm *Segment) truncate(dropped int64) error {
+	if dropped == 0 {
+		return nil
+	}
+	return os.Truncate(sgm.outPath, sgm.outOffset)
+}
+
+// scan rebuilds the segment index from its file and returns the number of
+// bytes after the last valid record, leaving the file as it is.
+func (sgm *Segment) scan() (int64, error) {
 	input, err := os.Open(sgm.outPath)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer input.Close()
 
-	var buf [bufSize]byte
+	stat, err := input.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fileSize := stat.Size()
+
 	in := bufio.NewReaderSize(input, bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
-		} else if err != nil {
-			return err
+	offset, err := readSegmentHeader(in, fileSize)
+	if err != nil {
+		return 0, fmt.Errorf("segment %s: %w", filepath.Base(sgm.outPath), err)
+	}
+	sgm.outOffset = offset
+	if offset == 0 {
+		return fileSize, nil
+	}
+	end, err := scanRecords(in, offset, fileSize, func(e entry, offset, size int64) error {
+		if e.seq > sgm.maxSeq {
+			sgm.maxSeq = e.seq
+		}
+		if e.kind != recordBatch {
+			sgm.index[e.key] = recordPosition{offset, size}
 		}
-		size := binary.LittleEndian.Uint32(header)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	sgm.outOffset = end
+	return fileSize - end, nil
+}
 
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
+// scanRecords calls fn for every record read from in, which is at offset of a
+// file of fileSize bytes, with the offset and the size of the record. The
+// records of a batch are passed on, after the batch record, only once all of
+// them were read. Scanning stops at the end of the file, at the first torn or
+// corrupted record and at an incomplete batch, whose offset is returned.
+func scanRecords(in *bufio.Reader, offset, fileSize int64, fn func(e entry, offset, size int64) error) (int64, error) {
+	// next reads the record at offset. It reports false on the end of the
+	// file as well as on a torn or corrupted record.
+	next := func() (entry, int64, bool, error) {
+		var e entry
+		header, err := in.Peek(4)
+		if err != nil && err != io.EOF {
+			return e, 0, false, err
+		}
+		if len(header) < 4 || int64(binary.LittleEndian.Uint32(header)) > fileSize-offset {
+			return e, 0, false, nil
+		}
+
+		data, err := readRecord(in)
+		if err == io.ErrUnexpectedEOF || err == ErrCorrupted {
+			return e, 0, false, nil
+		}
+		if err != nil {
+			return e, 0, false, err
+		}
+		if e.Decode(data) != nil {
+			return e, 0, false, nil
 		}
-		n, err = in.Read(data)
+		size := int64(len(data))
+		offset += size
+		return e, size, true, nil
+	}
 
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
+	for {
+		start := offset
+		e, size, ok, err := next()
+		if err != nil || !ok {
+			return start, err
+		}
+		if e.kind != recordBatch {
+			if err := fn(e, start, size); err != nil {
+				return start, err
 			}
+			continue
+		}
 
-			var e entry
-			e.Decode(data)
-			sgm.index[e.key] = sgm.outOffset
-			sgm.outOffset += int64(n)
+		// A batch is applied only when all of its records made it to disk.
+		records := make([]entry, e.batchCount())
+		positions := make([]recordPosition, len(records))
+		for i := range records {
+			positions[i].offset = offset
+			record, size, ok, err := next()
+			if err != nil || !ok || record.kind == recordBatch {
+				return start, err
+			}
+			records[i], positions[i].size = record, size
+		}
+		if err := fn(e, start, size); err != nil {
+			return start, err
+		}
+		for i, record := range records {
+			if err := fn(record, positions[i].offset, positions[i].size); err != nil {
+				return start, err
+			}
 		}
 	}
-	return err
+}
+
+// seal stops accepting writes to an active segment, leaving its hint file
+// and Bloom filter to writeIndexFiles. Sealing an already sealed segment does
+// nothing.
+func (sgm *Segment) seal() error {
+	if sgm.writingChannel != nil {
+		sgm.removeWritingLoop()
+	}
+	if sgm.out == nil {
+		return nil
+	}
+	err := sgm.out.Close()
+	sgm.out = nil
+	if err != nil {
+		return err
+	}
+	sgm.mutex.Lock()
+	sgm.filesPending = true
+	sgm.mutex.Unlock()
+	return nil
+}
+
+// writeIndexFiles writes the hint file and the Bloom filter of a segment
+// sealed since. Sealing leaves them to it, as sorting the keys and syncing the
+// files would stall the writes waiting for the next segment. Both files can be
+// rebuilt from the segment, so failures are only logged.
+func (sgm *Segment) writeIndexFiles() {
+	sgm.mutex.Lock()
+	pending := sgm.filesPending
+	sgm.filesPending = false
+	sgm.mutex.Unlock()
+	if !pending {
+		return
+	}
+	if err := sgm.writeHint(); err != nil {
+		log.Printf("Segment %s: cannot write hint file: %s", sgm.outPath, err)
+	}
+	if err := sgm.buildBloom(); err != nil {
+		log.Printf("Segment %s: cannot write bloom filter: %s", sgm.outPath, err)
+	}
 }
 
 func (sgm *Segment) Close() error {
-	return sgm.out.Close()
+	err := sgm.seal()
+	sgm.writeIndexFiles()
+	if closeErr := sgm.closeReader(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (sgm *Segment) closeReader() error {
+	var err error
+	sgm.inClose.Do(func() {
+		err = sgm.in.Close()
+		sgm.mutex.Lock()
+		if sgm.sparse != nil {
+			if closeErr := sgm.sparse.close(); err == nil {
+				err = closeErr
+			}
+		}
+		sgm.mutex.Unlock()
+	})
+	return err
 }
 
-func (sgm *Segment) GetAllData() (map[string]string, error) {
-	all := make(map[string]string)
+// lookup finds the record of key in the segment index.
+func (sgm *Segment) lookup(key string) (recordPosition, bool, error) {
+	sgm.mutex.Lock()
+	if sgm.bloom != nil && !sgm.bloom.mayContain(key) {
+		sgm.mutex.Unlock()
+		return recordPosition{}, false, nil
+	}
+	if sgm.index != nil {
+		position, ok := sgm.index[key]
+		sgm.mutex.Unlock()
+		return position, ok, nil
+	}
+	sparse := sgm.sparse
+	sgm.mutex.Unlock()
+	return sparse.get(key)
+}
 
-	for key := range sgm.index {
-		val, err := sgm.Get(key)
+func (sgm *Segment) getEntry(key string) (entry, error) {
+	position, ok, err := sgm.lookup(key)
+	if err != nil {
+		return entry{}, err
+	}
+	if !ok {
+		return entry{}, ErrNotFound
+	}
+	return sgm.readAt(position)
+}
 
-		if err != nil {
-			return nil, err
+// indexCursor walks the entries of a segment index in key order.
+type indexCursor interface {
+	next() (string, recordPosition, bool, error)
+}
+
+type indexEntry struct {
+	key string
+	pos recordPosition
+}
+
+type sliceCursor []indexEntry
+
+func (sc *sliceCursor) next() (string, recordPosition, bool, error) {
+	if len(*sc) == 0 {
+		return "", recordPosition{}, false, nil
+	}
+	e := (*sc)[0]
+	*sc = (*sc)[1:]
+	return e.key, e.pos, true, nil
+}
+
+// cursor returns a cursor over the index as it is now.
+func (sgm *Segment) cursor() indexCursor {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+
+	if sgm.index == nil && sgm.sparse.count > 0 {
+		return sgm.sparse.reader(0)
+	}
+	entries := make(sliceCursor, 0, len(sgm.index))
+	for key, pos := range sgm.index {
+		entries = append(entries, indexEntry{key, pos})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return &entries
+}
+
+// forEach calls fn for every index entry in key order until it returns false.
+func (sgm *Segment) forEach(fn func(key string, pos recordPosition) bool) error {
+	cursor := sgm.cursor()
+	for {
+		key, pos, ok, err := cursor.next()
+		if err != nil || !ok {
+			return err
+		}
+		if !fn(key, pos) {
+			return nil
 		}
-		all[key] = val
 	}
-	return all, nil
 }
 
-func (sgm *Segment) Get(key string) (string, error) {
-	position, ok := sgm.index[key]
+// keySet returns the keys of the segment in order.
+func (sgm *Segment) keySet() keySet {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
 
-	if !ok {
-		return "", ErrNotFound
+	if sgm.index == nil {
+		return sgm.sparse
 	}
+	keys := make(sortedKeys, 0, len(sgm.index))
+	for key := range sgm.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// indexKeys returns the keys of the in-memory index.
+func (sgm *Segment) indexKeys() []string {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+
+	keys := make([]string, 0, len(sgm.index))
+	for key := range sgm.index {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// inMemory reports whether the keys of the segment are kept in memory.
+func (sgm *Segment) inMemory() bool {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+	return sgm.index != nil
+}
+
+// indexSize estimates the memory the in-memory index takes, or would take
+// if it was loaded.
+func (sgm *Segment) indexSize() int64 {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
 
-	file, err := os.Open(sgm.outPath)
+	if sgm.index == nil {
+		return sgm.sparse.fullSize()
+	}
+	var keyBytes int64
+	for key := range sgm.index {
+		keyBytes += int64(len(key))
+	}
+	return indexSize(len(sgm.index), keyBytes)
+}
+
+// useSparseIndex replaces the in-memory index of a sealed segment with a
+// sparse index over its hint file.
+func (sgm *Segment) useSparseIndex() error {
+	sparse, _, segmentSize, err := sgm.loadSparseIndex()
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+	if segmentSize != sgm.outOffset || sparse.count != len(sgm.index) {
+		sparse.close()
+		return fmt.Errorf("%w: it does not match the segment index", errBadHint)
+	}
+	sgm.sparse = sparse
+	sgm.index = nil
+	return nil
+}
+
+// useFullIndex loads the whole index of a segment opened with a sparse one.
+func (sgm *Segment) useFullIndex() error {
+	if err := sgm.loadHint(); err != nil {
+		return err
 	}
-	defer file.Close()
+	sgm.mutex.Lock()
+	sparse := sgm.sparse
+	sgm.sparse = nil
+	sgm.mutex.Unlock()
+	return sparse.close()
+}
 
-	_, err = file.Seek(position, 0)
+// loadSparse opens a sealed segment with a sparse index over its hint file.
+func (sgm *Segment) loadSparse() error {
+	sparse, maxSeq, segmentSize, err := sgm.loadSparseIndex()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+	sgm.sparse = sparse
+	sgm.index = nil
+	sgm.outOffset = segmentSize
+	sgm.maxSeq = maxSeq
+	return nil
+}
+
+func (sgm *Segment) readAt(position recordPosition) (entry, error) {
+	data := make([]byte, position.size)
+	_, err := sgm.in.ReadAt(data, position.offset)
+	if err == io.EOF {
+		return entry{}, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return entry{}, err
+	}
+
+	var e entry
+	if err := e.Decode(data); err != nil {
+		return entry{}, err
+	}
+	return e, e.decrypt(sgm.keyring)
+}
+
+// Get returns the value stored for key in this segment. A key deleted in this
+// segment is reported as errDeleted so that older segments are not consulted.
+func (sgm *Segment) Get(key string) (string, error) {
+	e, err := sgm.getEntry(key)
 	if err != nil {
 		return "", err
 	}
-	return value, nil
+	if e.deleted() {
+		return "", errDeleted
+	}
+	return e.value, nil
 }
 
 func (sgm *Segment) Put(data ChannelData) error {
@@ -158,36 +601,277 @@ func (sgm *Segment) Put(data ChannelData) error {
 	return nil
 }
 
+// maxGroupSize limits the number of queued writes committed together.
+const maxGroupSize = 128
+
+// writingLoop appends queued writes to the segment. Writes queued while the
+// previous group was being committed are written together and, depending on
+// the sync policy, flushed with a single fsync before any of them is
+// acknowledged.
 func (sgm *Segment) writingLoop() error {
 	if sgm.writingChannel == nil {
 		return fmt.Errorf("No writing channel")
 	}
+	defer close(sgm.writingDone)
 
-	for channelData := range sgm.writingChannel {
-		sgm.mutex.Lock()
+	var tick <-chan time.Time
+	if sgm.syncPolicy == SyncInterval {
+		ticker := time.NewTicker(sgm.syncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
-		data := channelData.data
+	dirty := false
+	group := make([]ChannelData, 0, maxGroupSize)
+	for {
+		select {
+		case channelData, ok := <-sgm.writingChannel:
+			if !ok {
+				if dirty && sgm.syncPolicy != SyncNever {
+					if err := sgm.out.Sync(); err != nil {
+						log.Printf("Segment %s: %s", sgm.outPath, err)
+					}
+				}
+				return nil
+			}
+			group = append(group[:0], channelData)
+			group = sgm.receiveGroup(group)
+			sgm.commit(group)
+			dirty = sgm.syncPolicy != SyncAlways
+		case <-tick:
+			if dirty {
+				if err := sgm.out.Sync(); err != nil {
+					log.Printf("Segment %s: %s", sgm.outPath, err)
+				}
+				dirty = false
+			}
+		}
+	}
+}
 
-		n, err := sgm.out.Write(data.Encode())
+// receiveGroup appends the writes already waiting in the queue to group.
+func (sgm *Segment) receiveGroup(group []ChannelData) []ChannelData {
+	for len(group) < maxGroupSize {
+		select {
+		case channelData, ok := <-sgm.writingChannel:
+			if !ok {
+				return group
+			}
+			group = append(group, channelData)
+		default:
+			return group
+		}
+	}
+	return group
+}
 
-		if err != nil {
-			channelData.errorChannel <- err
+// commit writes a group of writes with a single write call and answers each
+// of them.
+func (sgm *Segment) commit(group []ChannelData) {
+	type pending struct {
+		entries   []entry
+		positions []recordPosition
+		values    [2]int
+		err       error
+	}
+	writes := make([]pending, len(group))
+	var buf []byte
+	for i, channelData := range group {
+		w := &writes[i]
+		w.entries = []entry{channelData.data}
+		start := len(buf)
+		if channelData.batch != nil {
+			w.entries = channelData.batch
+			buf = append(buf, batchHeader(len(w.entries), w.entries[0].seq)...)
 		}
+		w.positions = make([]recordPosition, len(w.entries))
+		for j := range w.entries {
+			record, stored, err := w.entries[j].encode(sgm.keyring)
+			if err != nil {
+				w.err = err
+				buf = buf[:start]
+				break
+			}
+			w.values[0] += len(w.entries[j].value)
+			w.values[1] += stored
+			w.positions[j] = recordPosition{int64(len(buf)), int64(len(record))}
+			buf = append(buf, record...)
+		}
+	}
 
-		if data.value != marker {
-			sgm.index[data.key] = sgm.outOffset
+	sgm.mutex.Lock()
+	n, err := sgm.out.Write(buf)
+	if err == nil && sgm.syncPolicy == SyncAlways {
+		err = sgm.out.Sync()
+	}
+	for i := range writes {
+		w := &writes[i]
+		if w.err == nil {
+			w.err = err
 		}
-		sgm.outOffset += int64(n)
+		if w.err != nil {
+			continue
+		}
+		for j := range w.entries {
+			pos := w.positions[j]
+			pos.offset += sgm.outOffset
+			sgm.liveSize += pos.size - sgm.index[w.entries[j].key].size
+			sgm.index[w.entries[j].key] = pos
+			if w.entries[j].seq > sgm.maxSeq {
+				sgm.maxSeq = w.entries[j].seq
+			}
+		}
+		sgm.values.add(w.values[0], w.values[1])
+	}
+	sgm.outOffset += int64(n)
+	sgm.mutex.Unlock()
 
-		channelData.errorChannel <- err
+	for i, channelData := range group {
+		channelData.errorChannel <- writes[i].err
+	}
+}
 
-		sgm.mutex.Unlock()
+// segmentWriter writes a new segment, such as the output of a merge, as a
+// single buffered stream. The segment ignores the sync policy and is flushed
+// to stable storage once, when it is finished.
+type segmentWriter struct {
+	sgm  *Segment
+	file *os.File
+	out  *bufio.Writer
+}
+
+func newSegmentWriter(path string, config segmentConfig) (*segmentWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
 	}
+	sgm, err := openSegment(false, path, 0, config)
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	w := &segmentWriter{sgm: sgm, file: file, out: bufio.NewWriterSize(file, 64*1024)}
+	if _, err := w.out.Write(segmentHeader()); err != nil {
+		w.abort()
+		return nil, err
+	}
+	sgm.outOffset = int64(segmentHeaderSize)
+	return w, nil
+}
 
-	return nil
+// write appends a record and returns its size.
+func (w *segmentWriter) write(e entry) (int64, error) {
+	record, stored, err := e.encode(w.sgm.keyring)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(record); err != nil {
+		return 0, err
+	}
+	size := int64(len(record))
+	sgm := w.sgm
+	sgm.mutex.Lock()
+	sgm.index[e.key] = recordPosition{sgm.outOffset, size}
+	sgm.outOffset += size
+	if e.seq > sgm.maxSeq {
+		sgm.maxSeq = e.seq
+	}
+	sgm.mutex.Unlock()
+	sgm.values.add(len(e.value), stored)
+	return size, nil
+}
+
+// finish flushes the segment to stable storage, writes its hint file and
+// Bloom filter, and returns it sealed. The files are removed on failure.
+func (w *segmentWriter) finish() (*Segment, error) {
+	err := w.out.Flush()
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = w.sgm.writeHint()
+	}
+	if err == nil {
+		err = w.sgm.buildBloom()
+	}
+	if err != nil {
+		w.sgm.removeFiles()
+		return nil, err
+	}
+	return w.sgm, nil
+}
+
+// abort removes the files of an unfinished segment.
+func (w *segmentWriter) abort() {
+	w.file.Close()
+	w.sgm.removeFiles()
 }
 
+func (sgm *Segment) acquire() {
+	atomic.AddInt32(&sgm.refs, 1)
+}
+
+func (sgm *Segment) release() {
+	if atomic.AddInt32(&sgm.refs, -1) == 0 && atomic.LoadInt32(&sgm.retired) == 1 {
+		sgm.removeFiles()
+	}
+}
+
+// retire marks a segment replaced by a merge. Its files are removed as soon
+// as no reader uses it.
+func (sgm *Segment) retire() {
+	atomic.StoreInt32(&sgm.retired, 1)
+	if atomic.LoadInt32(&sgm.refs) == 0 {
+		sgm.removeFiles()
+	}
+}
+
+func (sgm *Segment) removeFiles() {
+	if !atomic.CompareAndSwapInt32(&sgm.removed, 0, 1) {
+		return
+	}
+	if err := sgm.closeReader(); err != nil {
+		log.Printf("Segment %s: %s", sgm.outPath, err)
+	}
+	for _, path := range []string{sgm.outPath, hintPath(sgm.outPath), bloomPath(sgm.outPath)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Segment %s: %s", sgm.outPath, err)
+		}
+	}
+}
+
+// removeWritingLoop stops the writing loop once it has handled every record
+// already passed to Put.
 func (sgm *Segment) removeWritingLoop() {
 	close(sgm.writingChannel)
+	<-sgm.writingDone
 	sgm.writingChannel = nil
 }
+
+// offset returns the number of bytes written to the segment.
+func (sgm *Segment) offset() int64 {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+	return sgm.outOffset
+}
+
+// sizes returns the size of the segment and the part of it that is live. A
+// segment that was not measured yet is taken as live as a whole.
+func (sgm *Segment) sizes() (int64, int64) {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+	if sgm.liveSize < 0 {
+		return sgm.outOffset, sgm.outOffset
+	}
+	return sgm.outOffset, sgm.liveSize
+}
+
+func (sgm *Segment) setLiveSize(size int64) {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+	sgm.liveSize = size
+}
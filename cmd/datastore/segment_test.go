@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -15,7 +17,7 @@ func createUniqueString(i int) string {
 	return fmt.Sprintf("%010d", i)
 }
 
-const dataIteration = KB * numOfSegments / 32
+var dataIteration = KB * numOfSegments / len((&entry{key: createUniqueString(0), value: createUniqueString(0), seq: 1}).Encode())
 
 func Test_Segment(t *testing.T) {
 	dir, err := ioutil.TempDir(".", "test-segment-*")
@@ -39,7 +41,7 @@ func Test_Segment(t *testing.T) {
 
 	time.Sleep(time.Duration(100 * time.Millisecond))
 
-	if len(db.segments) != 2 {
+	if len(db.getSegments()) != 2 {
 		t.Error("Segments are not merged")
 	}
 
@@ -56,7 +58,396 @@ func Test_Segment(t *testing.T) {
 
 	files, err := ioutil.ReadDir(dir)
 
-	if len(files) > 2 {
+	segmentFiles := 0
+	for _, file := range files {
+		if isSegmentFile(file.Name()) {
+			segmentFiles++
+		}
+	}
+	if segmentFiles > 2 {
 		t.Error("Too many file in dir")
 	}
 }
+
+func Test_SegmentRecoverTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-segment-torn-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "1")
+	data := segmentHeader()
+	for _, pair := range pairs {
+		data = append(data, (&entry{key: pair[0], value: pair[1]}).Encode()...)
+	}
+	valid := int64(len(data))
+	torn := (&entry{key: "key4", value: "value4"}).Encode()
+	data = append(data, torn[:len(torn)-3]...)
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sgm, err := NewSegment(false, path, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped, err := sgm.recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != int64(len(torn)-3) {
+		t.Errorf("Bad dropped size: expected %d, got %d", len(torn)-3, dropped)
+	}
+	if sgm.outOffset != valid {
+		t.Errorf("Bad offset: expected %d, got %d", valid, sgm.outOffset)
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() != valid {
+		t.Errorf("Segment file is not truncated")
+	}
+	for _, pair := range pairs {
+		value, err := sgm.Get(pair[0])
+		if err != nil || value != pair[1] {
+			t.Errorf("Bad value for %s: %s (%v)", pair[0], value, err)
+		}
+	}
+	if _, err := sgm.Get("key4"); err != ErrNotFound {
+		t.Errorf("Torn record is indexed")
+	}
+}
+
+func Test_SegmentRecoverCorruptedRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-segment-corrupted-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := db.segments[len(db.segments)-1].outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash leaves the active segment without a hint file.
+	if err := os.Remove(hintPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	recovered := db.Recovered()
+	if len(recovered) != 1 || recovered[0].Path != path {
+		t.Fatalf("Bad recovery report: %v", recovered)
+	}
+	last := (&entry{key: pairs[2][0], value: pairs[2][1], seq: 3}).Encode()
+	if recovered[0].Dropped != int64(len(last)) {
+		t.Errorf("Bad dropped size: expected %d, got %d", len(last), recovered[0].Dropped)
+	}
+	for _, pair := range pairs[:2] {
+		value, err := db.Get(pair[0])
+		if err != nil || value != pair[1] {
+			t.Errorf("Bad value for %s: %s (%v)", pair[0], value, err)
+		}
+	}
+}
+
+func Test_SegmentRecoverDamagedFirstRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-segment-first-record-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "1")
+	data := append(segmentHeader(), (&entry{key: "key1", value: "value1"}).Encode()...)
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sgm, err := NewSegment(false, path, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sgm.Close()
+	// A crash during the first write to a segment leaves such a record.
+	if dropped, err := sgm.recover(); err != nil || dropped != int64(len(data)-segmentHeaderSize) {
+		t.Errorf("Bad recovery of a damaged first record: dropped %d (%v)", dropped, err)
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() != int64(segmentHeaderSize) {
+		t.Errorf("Segment file is not cut back to its header (%v)", err)
+	}
+
+	// Part of a header only is what a crash right after creating a segment
+	// leaves behind.
+	if err := ioutil.WriteFile(path, segmentHeader()[:5], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sgm, err = NewSegment(false, path, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sgm.Close()
+	if dropped, err := sgm.recover(); err != nil || dropped != 5 {
+		t.Errorf("Bad recovery of a torn header: dropped %d (%v)", dropped, err)
+	}
+}
+
+func Test_SegmentGroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-segment-group-commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, policy := range []SyncPolicy{SyncNever, SyncInterval, SyncAlways} {
+		t.Run(policy.String(), func(t *testing.T) {
+			path := filepath.Join(dir, policy.String())
+			sgm, err := openSegment(true, path, segmentSize, segmentConfig{
+				syncPolicy:   policy,
+				syncInterval: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const writes = 2 * maxGroupSize
+			errorChannels := make([]chan error, writes)
+			for i := range errorChannels {
+				errorChannels[i] = make(chan error, 1)
+				e := entry{key: createUniqueString(i), value: createUniqueString(i), seq: uint64(i + 1)}
+				if err := sgm.Put(ChannelData{data: e, errorChannel: errorChannels[i]}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, errorChannel := range errorChannels {
+				if err := <-errorChannel; err != nil {
+					t.Fatalf("Write %d failed: %s", i, err)
+				}
+			}
+			if err := sgm.seal(); err != nil {
+				t.Fatal(err)
+			}
+
+			recovered, err := NewSegment(false, path, segmentSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := recovered.recover(); err != nil {
+				t.Fatal(err)
+			}
+			if len(recovered.index) != writes || recovered.maxSeq != writes {
+				t.Errorf("Recovered %d keys up to seq %d", len(recovered.index), recovered.maxSeq)
+			}
+			for i := 0; i < writes; i++ {
+				value, err := recovered.Get(createUniqueString(i))
+				if err != nil || value != createUniqueString(i) {
+					t.Fatalf("Bad value for %d: %s (%v)", i, value, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_SegmentWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-segment-writer-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "1")
+	w, err := newSegmentWriter(path, segmentConfig{syncPolicy: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, pair := range pairs {
+		if _, err := w.write(entry{key: pair[0], value: pair[1], kind: recordPut, seq: uint64(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sgm, err := w.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sgm.Close()
+	for _, pair := range pairs {
+		if value, err := sgm.Get(pair[0]); err != nil || value != pair[1] {
+			t.Errorf("Bad value for %s: %s (%v)", pair[0], value, err)
+		}
+	}
+
+	hinted, err := NewSegment(false, path, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hinted.Close()
+	if err := hinted.loadHint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hinted.loadBloom(); err != nil {
+		t.Fatal(err)
+	}
+	scanned, err := NewSegment(false, path, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scanned.Close()
+	if dropped, err := scanned.recover(); err != nil || dropped != 0 {
+		t.Fatalf("Bad segment file: dropped %d (%v)", dropped, err)
+	}
+	if !reflect.DeepEqual(hinted.index, scanned.index) || hinted.maxSeq != uint64(len(pairs)) {
+		t.Errorf("Hint file does not match the records")
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncNever, SyncInterval, SyncAlways} {
+		if parsed, ok := ParseSyncPolicy(policy.String()); !ok || parsed != policy {
+			t.Errorf("Policy %s is parsed as %s", policy, parsed)
+		}
+	}
+	if _, ok := ParseSyncPolicy("sometimes"); ok {
+		t.Error("Unknown policy is parsed")
+	}
+}
+
+func BenchmarkSegment_Get(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench-segment-get")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sgm, err := NewSegment(true, filepath.Join(dir, "segment"), segmentSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sgm.Close()
+
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		errorChannel := make(chan error)
+		e := entry{key: createUniqueString(i), value: createUniqueString(i)}
+		if err := sgm.Put(ChannelData{data: e, errorChannel: errorChannel}); err != nil {
+			b.Fatal(err)
+		}
+		if err := <-errorChannel; err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sgm.Get(createUniqueString(i % keys)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDb_RecoverTornFirstRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-torn-first-record-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	path := db.segments[len(db.segments)-1].outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Power loss during the first write after a rollover.
+	if err := os.Remove(hintPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, stat.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	recovered := db.Recovered()
+	if len(recovered) != 1 || recovered[0].Path != path || recovered[0].Dropped != stat.Size()-3-int64(segmentHeaderSize) {
+		t.Errorf("Bad recovery report: %v", recovered)
+	}
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a torn record, got %v", err)
+	}
+}
+
+func TestDb_IndexFilesOffWritePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-index-files-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100, WithCompactionTrigger(CompactionTrigger{MinSegments: 100}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Sealing leaves the files to the compaction worker, which is kept from
+	// running meanwhile.
+	db.compactor.passMutex.Lock()
+	for i := 0; i < 10; i++ {
+		if err := db.Put(createUniqueString(i), createUniqueString(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sgms := db.getSegments()
+	if len(sgms) < 2 {
+		t.Fatalf("Expected several segments, got %d", len(sgms))
+	}
+	sealed := sgms[0].outPath
+	for _, path := range []string{hintPath(sealed), bloomPath(sealed)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is written on the write path (%v)", path, err)
+		}
+	}
+	db.compactor.passMutex.Unlock()
+
+	db.compactor.waitIdle()
+	for _, path := range []string{hintPath(sealed), bloomPath(sealed)} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s is not written by the compaction worker (%v)", path, err)
+		}
+	}
+}
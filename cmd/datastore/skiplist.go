@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const skipListMaxLevel = 32
+
+type skipListNode struct {
+	key  string
+	next []*skipListNode
+}
+
+// skipList is an ordered set of keys safe for concurrent use.
+type skipList struct {
+	mutex  sync.RWMutex
+	head   skipListNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  skipListNode{next: make([]*skipListNode, skipListMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+func (sl *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && sl.rnd.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// findPath fills path with the last node before key on every level.
+func (sl *skipList) findPath(key string, path []*skipListNode) *skipListNode {
+	node := &sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		if path != nil {
+			path[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (sl *skipList) Insert(key string) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	var path [skipListMaxLevel]*skipListNode
+	if node := sl.findPath(key, path[:]); node != nil && node.key == key {
+		return
+	}
+
+	level := sl.randomLevel()
+	for ; sl.level < level; sl.level++ {
+		path[sl.level] = &sl.head
+	}
+	node := &skipListNode{key: key, next: make([]*skipListNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = path[i].next[i]
+		path[i].next[i] = node
+	}
+	sl.length++
+}
+
+func (sl *skipList) Delete(key string) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	sl.delete(key)
+}
+
+func (sl *skipList) delete(key string) {
+	var path [skipListMaxLevel]*skipListNode
+	node := sl.findPath(key, path[:])
+	if node == nil || node.key != key {
+		return
+	}
+	for i := range node.next {
+		path[i].next[i] = node.next[i]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.length--
+}
+
+func (sl *skipList) Len() int {
+	sl.mutex.RLock()
+	defer sl.mutex.RUnlock()
+	return sl.length
+}
+
+// Next returns the smallest key greater than key, or equal to it when
+// inclusive is set.
+func (sl *skipList) Next(key string, inclusive bool) (string, bool) {
+	sl.mutex.RLock()
+	defer sl.mutex.RUnlock()
+
+	node := sl.findPath(key, nil)
+	if node != nil && !inclusive && node.key == key {
+		node = node.next[0]
+	}
+	if node == nil {
+		return "", false
+	}
+	return node.key, true
+}
+
+// DeleteUnless removes every key for which keep returns false. keep is called
+// with the list locked, so no key can be inserted concurrently between the
+// check and the removal.
+func (sl *skipList) DeleteUnless(keys []string, keep func(key string) bool) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	for _, key := range keys {
+		if !keep(key) {
+			sl.delete(key)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package datastore
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	sl := newSkipList()
+	for _, i := range rand.Perm(1000) {
+		key := fmt.Sprintf("key%04d", i)
+		sl.Insert(key)
+		sl.Insert(key)
+	}
+	if sl.Len() != 1000 {
+		t.Fatalf("Bad length: %d", sl.Len())
+	}
+
+	for i := 1; i < 1000; i += 2 {
+		sl.Delete(fmt.Sprintf("key%04d", i))
+	}
+	sl.DeleteUnless([]string{"key0000", "key0002"}, func(key string) bool {
+		return key == "key0002"
+	})
+	if sl.Len() != 499 {
+		t.Fatalf("Bad length after delete: %d", sl.Len())
+	}
+
+	key, ok := "", true
+	for i := 2; i < 1000; i += 2 {
+		key, ok = sl.Next(key, false)
+		if expected := fmt.Sprintf("key%04d", i); !ok || key != expected {
+			t.Fatalf("Bad next key: expected %s, got %s", expected, key)
+		}
+	}
+	if _, ok := sl.Next(key, false); ok {
+		t.Error("Key after the last one is found")
+	}
+
+	if key, _ := sl.Next("key0004", true); key != "key0004" {
+		t.Errorf("Inclusive next skips the key: %s", key)
+	}
+	if key, _ := sl.Next("key0005", true); key != "key0006" {
+		t.Errorf("Bad next key for an absent key: %s", key)
+	}
+}
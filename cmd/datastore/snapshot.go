@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is a read-only view of the database as of the write with sequence
+// number Seq. Writes and merges that happen afterwards are not visible through
+// it, and the segment files it reads stay on disk until it is released. Keys
+// that expire after the snapshot is taken stay visible through it.
+type Snapshot struct {
+	seq      uint64
+	segments []*Segment
+	// active is a copy of the index of the segment that was active when the
+	// snapshot was taken, as that segment keeps being written.
+	active hashIndex
+	// now is the time the snapshot was taken, which records are checked
+	// for expiry against.
+	now      time.Time
+	blobs    *blobStore
+	released int32
+
+	keysOnce sync.Once
+	keys     mergedKeys
+}
+
+// Snapshot takes a snapshot of the database. It has to be released with
+// Release once it is no longer used.
+func (db *Db) Snapshot() *Snapshot {
+	db.writeMutex.Lock()
+	defer db.writeMutex.Unlock()
+	db.pending.Wait()
+
+	sgms := db.acquireSegments()
+	last := sgms[len(sgms)-1]
+	last.mutex.Lock()
+	active := make(hashIndex, len(last.index))
+	for key, pos := range last.index {
+		active[key] = pos
+	}
+	last.mutex.Unlock()
+	db.blobs.pin()
+
+	return &Snapshot{
+		seq:      db.seq,
+		segments: sgms,
+		active:   active,
+		now:      db.now(),
+		blobs:    db.blobs,
+	}
+}
+
+// Seq returns the sequence number of the latest write visible in the
+// snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Release lets the segment files of the snapshot be removed. The snapshot must
+// not be used afterwards.
+func (s *Snapshot) Release() {
+	if atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		releaseSegments(s.segments)
+		s.blobs.unpin()
+	}
+}
+
+// lookup finds the record of key in the i-th segment of the snapshot.
+func (s *Snapshot) lookup(i int, key string) (recordPosition, bool, error) {
+	if i == len(s.segments)-1 {
+		position, ok := s.active[key]
+		return position, ok, nil
+	}
+	return s.segments[i].lookup(key)
+}
+
+// find returns the newest live record of key in the snapshot. Values stored
+// in blobs are not read.
+func (s *Snapshot) find(key string) (entry, error) {
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		sgm := s.segments[i]
+		position, ok, err := s.lookup(i, key)
+		if err != nil {
+			return entry{}, err
+		}
+		if !ok {
+			continue
+		}
+
+		e, err := sgm.readAt(position)
+		if err != nil {
+			return entry{}, err
+		}
+		if e.deleted() || e.expired(s.now) {
+			return entry{}, ErrNotFound
+		}
+		return e, nil
+	}
+	return entry{}, ErrNotFound
+}
+
+func (s *Snapshot) get(key string) (entry, error) {
+	e, err := s.find(key)
+	if err == nil && e.kind == recordBlob {
+		e.value, err = s.blobs.read(e)
+	}
+	return e, err
+}
+
+func (s *Snapshot) Get(key string) (string, error) {
+	value, _, err := s.GetVersion(key)
+	return value, err
+}
+
+// GetVersion returns the value of key in the snapshot with its version.
+func (s *Snapshot) GetVersion(key string) (string, uint64, error) {
+	e, err := s.get(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return e.value, e.seq, nil
+}
+
+// keySet returns the keys of the snapshot, deleted ones included.
+func (s *Snapshot) keySet() keySet {
+	s.keysOnce.Do(func() {
+		active := make(sortedKeys, 0, len(s.active))
+		for key := range s.active {
+			active = append(active, key)
+		}
+		sort.Strings(active)
+		s.keys = mergedKeys{active}
+		for _, sgm := range s.segments[:len(s.segments)-1] {
+			s.keys = append(s.keys, sgm.keySet())
+		}
+	})
+	return s.keys
+}
+
+// Scan works as Db.Scan over the state of the snapshot.
+func (s *Snapshot) Scan(start, end string, limit int) *Iterator {
+	return &Iterator{
+		keys:  s.keySet(),
+		get:   s.Get,
+		end:   end,
+		limit: limit,
+		key:   start,
+	}
+}
+
+// Iterate works as Db.Iterate over the state of the snapshot.
+func (s *Snapshot) Iterate(prefix, cursor string, fn func(key, value string) bool) (string, error) {
+	return iterate(s.Scan, prefix, cursor, fn)
+}
+
+// sortedKeys is a keySet over a sorted slice.
+type sortedKeys []string
+
+func (keys sortedKeys) Next(key string, inclusive bool) (string, bool, error) {
+	i := sort.SearchStrings(keys, key)
+	if i < len(keys) && !inclusive && keys[i] == key {
+		i++
+	}
+	if i == len(keys) {
+		return "", false, nil
+	}
+	return keys[i], true, nil
+}
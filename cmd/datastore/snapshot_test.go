@@ -0,0 +1,160 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+
+	if err := db.Put("key1", "new-value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key4", "value4"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pair := range pairs {
+		value, err := snapshot.Get(pair[0])
+		if err != nil || value != pair[1] {
+			t.Errorf("Bad snapshot value for %s: %s (%v)", pair[0], value, err)
+		}
+	}
+	if _, err := snapshot.Get("key4"); err != ErrNotFound {
+		t.Errorf("Key written after the snapshot is visible: %v", err)
+	}
+	if value, _ := db.Get("key1"); value != "new-value1" {
+		t.Errorf("Bad current value: %s", value)
+	}
+
+	var scanned []string
+	it := snapshot.Scan("", "", 0)
+	for it.Next() {
+		scanned = append(scanned, it.Key()+"="+it.Value())
+	}
+	if expected := []string{"key1=value1", "key2=value2", "key3=value3"}; !equalStrings(scanned, expected) {
+		t.Errorf("Bad snapshot scan: expected %v, got %v", expected, scanned)
+	}
+}
+
+func TestDb_SnapshotCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-snapshot-compaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	put := func(round int) {
+		for i := 0; i < 10; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d-%d", i, round)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0)
+	db.compactor.waitIdle()
+
+	snapshot := db.Snapshot()
+	pinned := snapshot.segments
+	for round := 1; round < 5; round++ {
+		put(round)
+	}
+	db.compactor.waitIdle()
+
+	retired := 0
+	for _, sgm := range pinned {
+		if sgm.retired == 1 {
+			retired++
+		}
+		if _, err := os.Stat(sgm.outPath); err != nil {
+			t.Errorf("Snapshot segment is removed: %s", err)
+		}
+	}
+	if retired == 0 {
+		t.Fatal("No snapshot segment is merged")
+	}
+	for i := 0; i < 10; i++ {
+		value, err := snapshot.Get(fmt.Sprintf("key%d", i))
+		if expected := fmt.Sprintf("value%d-0", i); err != nil || value != expected {
+			t.Errorf("Bad snapshot value: expected %s, got %s (%v)", expected, value, err)
+		}
+	}
+
+	snapshot.Release()
+	for _, sgm := range pinned {
+		if _, err := os.Stat(sgm.outPath); sgm.retired == 1 && !os.IsNotExist(err) {
+			t.Errorf("Retired segment %s is kept after release", sgm.outPath)
+		}
+	}
+}
+
+func TestDb_SnapshotTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-snapshot-ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	db.now = func() time.Time { return now }
+
+	if err := db.PutWithTTL("session", "token", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+
+	now = now.Add(2 * time.Minute)
+
+	if _, err := db.Get("session"); err != ErrNotFound {
+		t.Errorf("Expired key is found: %v", err)
+	}
+	if value, err := snapshot.Get("session"); err != nil || value != "token" {
+		t.Errorf("Bad snapshot value for session: %s (%v)", value, err)
+	}
+	var scanned []string
+	it := snapshot.Scan("", "", 0)
+	for it.Next() {
+		scanned = append(scanned, it.Key()+"="+it.Value())
+	}
+	if expected := []string{"session=token"}; !equalStrings(scanned, expected) {
+		t.Errorf("Bad snapshot scan: expected %v, got %v", expected, scanned)
+	}
+}
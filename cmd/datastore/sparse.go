@@ -0,0 +1,246 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// sparseInterval is the number of hint entries in every block of a sparse
+// index.
+const sparseInterval = 64
+
+// indexEntryOverhead approximates the memory an in-memory index takes for a
+// key besides the key itself, counting its entry in the ordered key set.
+const indexEntryOverhead = 96
+
+var errUnsortedHint = fmt.Errorf("hint file is not sorted")
+
+// sparseIndex finds the records of a sealed segment through its hint file,
+// whose entries are sorted by key. Only the first key of every block of
+// sparseInterval entries is kept in memory.
+type sparseIndex struct {
+	file *os.File
+	// first holds the first key of every block and offsets the position of
+	// every block in the hint file followed by the end of the last one.
+	first   []string
+	offsets []int64
+	// count and keyBytes tell the number and the total length of the keys.
+	count    int
+	keyBytes int64
+}
+
+// indexSize estimates the memory an in-memory index of count keys of total
+// length keyBytes takes.
+func indexSize(count int, keyBytes int64) int64 {
+	return keyBytes + int64(count)*indexEntryOverhead
+}
+
+// fullSize estimates the memory the index would take if it was loaded.
+func (si *sparseIndex) fullSize() int64 {
+	return indexSize(si.count, si.keyBytes)
+}
+
+func (si *sparseIndex) close() error {
+	return si.file.Close()
+}
+
+// hintReader reads the entries of a hint file.
+type hintReader struct {
+	in     *bufio.Reader
+	offset int64
+	end    int64
+}
+
+func (hr *hintReader) next() (string, recordPosition, bool, error) {
+	if hr.offset >= hr.end {
+		return "", recordPosition{}, false, nil
+	}
+	var field [16]byte
+	if _, err := io.ReadFull(hr.in, field[:4]); err != nil {
+		return "", recordPosition{}, false, errBadHint
+	}
+	kl := int64(binary.LittleEndian.Uint32(field[:]))
+	if hr.offset+4+kl+16 > hr.end {
+		return "", recordPosition{}, false, errBadHint
+	}
+	key := make([]byte, kl)
+	if _, err := io.ReadFull(hr.in, key); err != nil {
+		return "", recordPosition{}, false, errBadHint
+	}
+	if _, err := io.ReadFull(hr.in, field[:]); err != nil {
+		return "", recordPosition{}, false, errBadHint
+	}
+	pos := recordPosition{
+		offset: int64(binary.LittleEndian.Uint64(field[:])),
+		size:   int64(binary.LittleEndian.Uint64(field[8:])),
+	}
+	hr.offset += 4 + kl + 16
+	return string(key), pos, true, nil
+}
+
+func (si *sparseIndex) reader(block int) *hintReader {
+	start, end := si.offsets[block], si.offsets[len(si.offsets)-1]
+	return &hintReader{
+		in:     bufio.NewReaderSize(io.NewSectionReader(si.file, start, end-start), bufSize),
+		offset: start,
+		end:    end,
+	}
+}
+
+// block returns the last block whose first key is not greater than key.
+func (si *sparseIndex) block(key string) int {
+	i := sort.SearchStrings(si.first, key)
+	if i < len(si.first) && si.first[i] == key {
+		return i
+	}
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+func (si *sparseIndex) get(key string) (recordPosition, bool, error) {
+	if si.count == 0 {
+		return recordPosition{}, false, nil
+	}
+	hr := si.reader(si.block(key))
+	for {
+		k, pos, ok, err := hr.next()
+		if err != nil || !ok || k > key {
+			return recordPosition{}, false, err
+		}
+		if k == key {
+			return pos, true, nil
+		}
+	}
+}
+
+// Next returns the smallest key greater than key, or equal to it when
+// inclusive is set.
+func (si *sparseIndex) Next(key string, inclusive bool) (string, bool, error) {
+	if si.count == 0 {
+		return "", false, nil
+	}
+	block := si.block(key)
+	hr := si.reader(block)
+	for hr.offset < si.offsets[block+1] {
+		k, _, ok, err := hr.next()
+		if err != nil || !ok {
+			return "", false, err
+		}
+		if k > key || inclusive && k == key {
+			return k, true, nil
+		}
+	}
+	if block+1 < len(si.first) {
+		return si.first[block+1], true, nil
+	}
+	return "", false, nil
+}
+
+// forEach calls fn for every entry in key order until it returns false.
+func (si *sparseIndex) forEach(fn func(key string, pos recordPosition) bool) error {
+	if si.count == 0 {
+		return nil
+	}
+	hr := si.reader(0)
+	for {
+		key, pos, ok, err := hr.next()
+		if err != nil || !ok {
+			return err
+		}
+		if !fn(key, pos) {
+			return nil
+		}
+	}
+}
+
+// loadSparseIndex reads the sorted hint file of a sealed segment into a
+// sparse index. It fails when the hint is missing, damaged, unsorted or does
+// not match the segment file.
+func (sgm *Segment) loadSparseIndex() (*sparseIndex, uint64, int64, error) {
+	file, err := os.Open(hintPath(sgm.outPath))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	si, maxSeq, segmentSize, err := readSparseIndex(file, sgm.outPath)
+	if err != nil {
+		file.Close()
+		return nil, 0, 0, err
+	}
+	return si, maxSeq, segmentSize, nil
+}
+
+func readSparseIndex(file *os.File, segmentPath string) (*sparseIndex, uint64, int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	segmentStat, err := os.Stat(segmentPath)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	end := stat.Size() - hintFooterSize
+	if end < 0 {
+		return nil, 0, 0, errBadHint
+	}
+
+	footer := make([]byte, hintFooterSize)
+	if _, err := file.ReadAt(footer, end); err != nil {
+		return nil, 0, 0, err
+	}
+	maxSeq := binary.LittleEndian.Uint64(footer)
+	segmentSize := int64(binary.LittleEndian.Uint64(footer[8:]))
+	if segmentSize != segmentStat.Size() {
+		return nil, 0, 0, fmt.Errorf("%w: segment size %d does not match %d", errBadHint, segmentStat.Size(), segmentSize)
+	}
+
+	crc := crc32.NewIEEE()
+	hr := &hintReader{
+		in:  bufio.NewReaderSize(io.TeeReader(io.NewSectionReader(file, 0, end), crc), bufSize),
+		end: end,
+	}
+	si := &sparseIndex{file: file}
+	last := ""
+	for {
+		offset := hr.offset
+		key, pos, ok, err := hr.next()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if !ok {
+			break
+		}
+		if si.count > 0 && key <= last {
+			return nil, 0, 0, errUnsortedHint
+		}
+		if pos.offset < 0 || pos.size < minRecordSize || pos.offset+pos.size > segmentSize {
+			return nil, 0, 0, errBadHint
+		}
+		if si.count%sparseInterval == 0 {
+			si.first = append(si.first, key)
+			si.offsets = append(si.offsets, offset)
+		}
+		si.count++
+		si.keyBytes += int64(len(key))
+		last = key
+	}
+	si.offsets = append(si.offsets, end)
+
+	// The checksum covers everything before it, the entries having passed
+	// through it while being read.
+	if _, err := io.Copy(ioutil.Discard, hr.in); err != nil {
+		return nil, 0, 0, err
+	}
+	crc.Write(footer[:hintFooterSize-4])
+	if binary.LittleEndian.Uint32(footer[hintFooterSize-4:]) != crc.Sum32() {
+		return nil, 0, 0, errBadHint
+	}
+	return si, maxSeq, segmentSize, nil
+}
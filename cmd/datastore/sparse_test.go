@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestSparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-sparse-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sgm, err := NewSegment(true, filepath.Join(dir, "segment"), segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keys = 5*sparseInterval + 3
+	for i := 0; i < keys; i++ {
+		errorChannel := make(chan error)
+		e := entry{key: createUniqueString(2 * i), value: createUniqueString(i)}
+		if err := sgm.Put(ChannelData{data: e, errorChannel: errorChannel}); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errorChannel; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sgm.seal(); err != nil {
+		t.Fatal(err)
+	}
+	sgm.writeIndexFiles()
+	full := make(hashIndex)
+	for key, pos := range sgm.index {
+		full[key] = pos
+	}
+	if err := sgm.useSparseIndex(); err != nil {
+		t.Fatal(err)
+	}
+	defer sgm.Close()
+	if sgm.inMemory() || len(sgm.sparse.first) != 6 {
+		t.Fatalf("Unexpected sparse index with %d blocks", len(sgm.sparse.first))
+	}
+
+	t.Run("lookup", func(t *testing.T) {
+		for i := 0; i < 2*keys+1; i++ {
+			key := createUniqueString(i)
+			pos, ok, err := sgm.lookup(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, found := full[key]; ok != found || pos != expected {
+				t.Errorf("Bad position for %s: %v %v", key, pos, ok)
+			}
+		}
+		value, err := sgm.Get(createUniqueString(2 * sparseInterval))
+		if err != nil || value != createUniqueString(sparseInterval) {
+			t.Errorf("Bad value: %s (%v)", value, err)
+		}
+	})
+
+	t.Run("next", func(t *testing.T) {
+		var got []string
+		key, inclusive := "", true
+		for {
+			next, ok, err := sgm.sparse.Next(key, inclusive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			got = append(got, next)
+			key, inclusive = next, false
+		}
+		if len(got) != keys || !sort.StringsAreSorted(got) {
+			t.Errorf("Next visited %d keys", len(got))
+		}
+		if next, _, _ := sgm.sparse.Next(createUniqueString(1), false); next != createUniqueString(2) {
+			t.Errorf("Unexpected key after an absent one: %s", next)
+		}
+	})
+}
+
+func TestDb_IndexBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-index-budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const keys = 300
+	opts := []Option{
+		WithIndexBudget(indexSize(20, 200)),
+		WithCompactionPolicy(SizeTieredPolicy{MinSegments: 4, BucketLow: 0.5, BucketHigh: 1.5}),
+	}
+	db, err := NewDb(dir, 1024, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < keys; i++ {
+		if err := db.Put(createUniqueString(i), createUniqueString(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < keys; i += 10 {
+		if err := db.Delete(createUniqueString(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactor.waitIdle()
+	db.startCompaction()
+	db.compactor.waitIdle()
+
+	check := func(t *testing.T, db *Db) {
+		sparse := 0
+		for _, sgm := range db.getSegments() {
+			if !sgm.inMemory() {
+				sparse++
+			}
+		}
+		if sparse == 0 {
+			t.Error("No segment has a sparse index")
+		}
+		if db.keys.Len() >= keys {
+			t.Errorf("%d keys are kept in memory", db.keys.Len())
+		}
+
+		for i := 0; i < keys; i++ {
+			value, err := db.Get(createUniqueString(i))
+			if i%10 == 0 {
+				if err != ErrNotFound {
+					t.Errorf("Deleted key %d is found: %v", i, err)
+				}
+			} else if err != nil || value != createUniqueString(i) {
+				t.Errorf("Bad value for %d: %s (%v)", i, value, err)
+			}
+		}
+
+		var expected []string
+		for i := 0; i < keys; i++ {
+			if i%10 != 0 {
+				expected = append(expected, createUniqueString(i))
+			}
+		}
+		var scanned []string
+		it := db.Scan("", "", 0)
+		for it.Next() {
+			scanned = append(scanned, it.Key())
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if !equalStrings(scanned, expected) {
+			t.Errorf("Scan returned %d keys, expected %d", len(scanned), len(expected))
+		}
+	}
+
+	t.Run("sparse", func(t *testing.T) { check(t, db) })
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 1024, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	t.Run("recovered", func(t *testing.T) { check(t, db) })
+}
@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes the state of a Db.
+type Stats struct {
+	// ValueBytes is the size of the values written since the database was
+	// opened, merges included, and StoredValueBytes is the space they took
+	// in segment files.
+	ValueBytes       int64
+	StoredValueBytes int64
+
+	// CacheHits and CacheMisses count lookups served by the value cache and
+	// passed on to the segments. CacheBytes is the memory the cache holds.
+	CacheHits   int64
+	CacheMisses int64
+	CacheBytes  int64
+
+	// Segments is the number of segments, the active one included, and
+	// TotalBytes their size on disk. LiveBytes is the part of it taken by
+	// the newest records of their keys, and DeadBytes the part merges can
+	// reclaim. Sealed segments are measured by the compaction pass that runs
+	// whenever a new segment is started, so their share lags behind writes
+	// made since.
+	Segments   int
+	TotalBytes int64
+	LiveBytes  int64
+	DeadBytes  int64
+
+	// Keys is the number of keys with a record in the segments. Deleted
+	// keys are counted until merges drop their tombstones, and keys of
+	// segments with a sparse index may be counted more than once.
+	Keys int64
+
+	// ActiveBytes is the size of the active segment and ActiveFill the
+	// share of the segment size it takes.
+	ActiveBytes int64
+	ActiveFill  float64
+
+	// Merges counts the merges since the database was opened and
+	// MergeDuration is the time they took. LastMergeDuration is the time the
+	// latest of them took.
+	Merges            int64
+	MergeDuration     time.Duration
+	LastMergeDuration time.Duration
+
+	// CompactionErrors counts the failed compaction passes and
+	// CompactionError is the error of the latest of them.
+	CompactionErrors int64
+	CompactionError  error
+}
+
+// CompressionRatio returns how many times values shrank when stored.
+func (s Stats) CompressionRatio() float64 {
+	if s.StoredValueBytes == 0 {
+		return 1
+	}
+	return float64(s.ValueBytes) / float64(s.StoredValueBytes)
+}
+
+// valueStats counts the bytes of values written to segments.
+type valueStats struct {
+	raw, stored int64
+}
+
+func (vs *valueStats) add(raw, stored int) {
+	if vs == nil {
+		return
+	}
+	atomic.AddInt64(&vs.raw, int64(raw))
+	atomic.AddInt64(&vs.stored, int64(stored))
+}
+
+// mergeStats counts the merges of a Db.
+type mergeStats struct {
+	count, nanos, last int64
+}
+
+// track records a merge started at start.
+func (ms *mergeStats) track(start time.Time) {
+	elapsed := int64(time.Since(start))
+	atomic.AddInt64(&ms.count, 1)
+	atomic.AddInt64(&ms.nanos, elapsed)
+	atomic.StoreInt64(&ms.last, elapsed)
+}
+
+// Stats returns a snapshot of the database statistics.
+func (db *Db) Stats() Stats {
+	stats := Stats{
+		ValueBytes:        atomic.LoadInt64(&db.values.raw),
+		StoredValueBytes:  atomic.LoadInt64(&db.values.stored),
+		Merges:            atomic.LoadInt64(&db.merged.count),
+		MergeDuration:     time.Duration(atomic.LoadInt64(&db.merged.nanos)),
+		LastMergeDuration: time.Duration(atomic.LoadInt64(&db.merged.last)),
+		Keys:              int64(db.keys.Len()),
+		CompactionErrors:  atomic.LoadInt64(&db.compactor.errors),
+		CompactionError:   db.compactor.lastError(),
+	}
+	if db.cache != nil {
+		stats.CacheHits = atomic.LoadInt64(&db.cache.hits)
+		stats.CacheMisses = atomic.LoadInt64(&db.cache.misses)
+		stats.CacheBytes = db.cache.bytes()
+	}
+
+	sgms := db.getSegments()
+	stats.Segments = len(sgms)
+	for _, sgm := range sgms {
+		size, live := sgm.sizes()
+		stats.TotalBytes += size
+		stats.LiveBytes += live
+		stats.ActiveBytes = size
+		sgm.mutex.Lock()
+		if sgm.index == nil {
+			stats.Keys += int64(sgm.sparse.count)
+		}
+		sgm.mutex.Unlock()
+	}
+	stats.DeadBytes = stats.TotalBytes - stats.LiveBytes
+	if db.segmentSize > 0 {
+		stats.ActiveFill = float64(stats.ActiveBytes) / float64(db.segmentSize)
+	}
+	return stats
+}
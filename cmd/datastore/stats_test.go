@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 60, WithCompactionPolicy(GarbageRatioPolicy{Threshold: 0.5}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(createUniqueString(i%3), createUniqueString(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactor.waitIdle()
+	db.startCompaction()
+	db.compactor.waitIdle()
+
+	stats := db.Stats()
+	sgms := db.getSegments()
+	var total int64
+	for _, sgm := range sgms {
+		total += sgm.offset()
+	}
+	active := sgms[len(sgms)-1].offset()
+	if stats.Segments != len(sgms) || stats.TotalBytes != total || stats.ActiveBytes != active {
+		t.Errorf("Bad segment stats: %+v", stats)
+	}
+	if stats.ActiveFill != float64(active)/60 {
+		t.Errorf("Bad active fill %f", stats.ActiveFill)
+	}
+	if stats.Keys != 3 {
+		t.Errorf("Expected 3 keys, got %d", stats.Keys)
+	}
+	if stats.Merges == 0 || stats.MergeDuration < stats.LastMergeDuration || stats.LastMergeDuration <= 0 {
+		t.Errorf("Bad merge stats: %+v", stats)
+	}
+	if stats.LiveBytes+stats.DeadBytes != stats.TotalBytes || stats.LiveBytes <= 0 {
+		t.Errorf("Bad live size: %+v", stats)
+	}
+
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const octetStream = "application/octet-stream"
+
+// requestType returns the media type of the request body without parameters.
+func requestType(r *http.Request) string {
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return header
+	}
+	return mediaType
+}
+
+// acceptsOctetStream reports whether the client asks for raw values.
+func acceptsOctetStream(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if mediaType == octetStream {
+			return true
+		}
+	}
+	return false
+}
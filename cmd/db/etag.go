@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Kolbasen/design-practice-2/cmd/datastore"
+)
+
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// matchETag reports whether a list of entity tags from an If-Match or
+// If-None-Match header matches the version of an existing key.
+func matchETag(header string, version uint64) bool {
+	if version == 0 {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == formatETag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// writePrecondition builds the precondition of a write from its If-Match and
+// If-None-Match headers, or returns nil when the write is unconditional.
+func writePrecondition(r *http.Request) datastore.Precondition {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+	return func(version uint64) bool {
+		if ifMatch != "" && !matchETag(ifMatch, version) {
+			return false
+		}
+		return ifNoneMatch == "" || !matchETag(ifNoneMatch, version)
+	}
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/Kolbasen/design-practice-2/cmd/datastore"
 	"github.com/Kolbasen/design-practice-2/httptools"
@@ -13,9 +17,20 @@ import (
 	"github.com/gorilla/mux"
 )
 
+const adminPrefix = "/db/_"
+
 var port = flag.Int("p", 8000, "port")
 var path = flag.String("d", ".db", "db path")
 var segmentSize = flag.Int("s", 10*MB, "segment size")
+var compress = flag.Bool("compress", false, "store values compressed")
+var syncPolicy = flag.String("sync", "never", "when writes are flushed to disk: always, interval or never")
+var syncInterval = flag.Duration("sync-interval", datastore.DefaultSyncInterval, "flush interval of the interval sync policy")
+var cacheSize = flag.Int64("cache", 0, "value cache size in bytes, 0 disables the cache")
+var indexBudget = flag.Int64("index-budget", 0, "memory budget of sealed segment indexes in bytes, 0 keeps them all in memory")
+var compactionRate = flag.Int64("compaction-rate", 0, "bytes per second merges may read and write, 0 leaves them unlimited")
+var compactionSegments = flag.Int("compaction-segments", 0, "number of sealed segments that starts a compaction pass")
+var compactionGarbage = flag.Float64("compaction-garbage", 0, "share of dead bytes in sealed segments that starts a compaction pass")
+var keyFile = flag.String("key-file", "", "file with encryption keys, overrides "+datastore.KeysEnv)
 
 const teamName = "kfcteam"
 const MB = 1024 * 1024
@@ -27,8 +42,50 @@ type Response struct {
 
 type RequestPayload struct {
 	Value string `json:"value"`
+	// TTL is the number of seconds the value lives for, 0 keeps it forever.
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+type BatchOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type BatchPayload struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+type ListResponse struct {
+	Items  []Response `json:"items"`
+	Cursor string     `json:"cursor,omitempty"`
 }
 
+// StatsResponse mirrors datastore.Stats, with durations in seconds.
+type StatsResponse struct {
+	Segments         int     `json:"segments"`
+	TotalBytes       int64   `json:"total_bytes"`
+	LiveBytes        int64   `json:"live_bytes"`
+	DeadBytes        int64   `json:"dead_bytes"`
+	Keys             int64   `json:"keys"`
+	ActiveBytes      int64   `json:"active_bytes"`
+	ActiveFill       float64 `json:"active_fill"`
+	Merges           int64   `json:"merges"`
+	MergeSeconds     float64 `json:"merge_seconds"`
+	LastMergeSeconds float64 `json:"last_merge_seconds"`
+	ValueBytes       int64   `json:"value_bytes"`
+	StoredValueBytes int64   `json:"stored_value_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+	CacheHits        int64   `json:"cache_hits"`
+	CacheMisses      int64   `json:"cache_misses"`
+	CacheBytes       int64   `json:"cache_bytes"`
+	CompactionErrors int64   `json:"compaction_errors"`
+	CompactionError  string  `json:"compaction_error,omitempty"`
+}
+
+const defaultListLimit = 100
+const maxListLimit = 1000
+
 func main() {
 	flag.Parse()
 
@@ -38,7 +95,34 @@ func main() {
 		return
 	}
 
-	db, err := datastore.NewDb(*path, int64(*segmentSize))
+	policy, ok := datastore.ParseSyncPolicy(*syncPolicy)
+	if !ok {
+		log.Printf("unknown sync policy %q", *syncPolicy)
+		return
+	}
+	opts := []datastore.Option{
+		datastore.WithSync(policy, *syncInterval),
+		datastore.WithCache(*cacheSize),
+		datastore.WithIndexBudget(*indexBudget),
+		datastore.WithCompactionRate(*compactionRate),
+		datastore.WithCompactionTrigger(datastore.CompactionTrigger{
+			MinSegments:  *compactionSegments,
+			GarbageRatio: *compactionGarbage,
+		}),
+	}
+	if *compress {
+		opts = append(opts, datastore.WithCompression())
+	}
+	keyring, err := datastore.LoadKeyring(*keyFile)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+	if keyring != nil {
+		opts = append(opts, datastore.WithEncryption(keyring))
+	}
+
+	db, err := datastore.NewDb(*path, int64(*segmentSize), opts...)
 	if err != nil {
 		log.Printf("%s", err)
 		return
@@ -49,6 +133,109 @@ func main() {
 
 	router := mux.NewRouter()
 
+	// The batch endpoint is matched before the routes of single keys, which
+	// are registered last. The other endpoints live under adminPrefix, which
+	// no key can shadow as a key is a single path segment.
+	router.HandleFunc("/db/_batch", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+
+		var body BatchPayload
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var batch datastore.WriteBatch
+		for _, op := range body.Operations {
+			switch op.Op {
+			case "put":
+				batch.Put(op.Key, op.Value)
+			case "delete":
+				batch.Delete(op.Key)
+			default:
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = db.Write(&batch)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}).Methods("POST")
+
+	router.HandleFunc(adminPrefix+"/stats", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+
+		stats := db.Stats()
+		res := StatsResponse{
+			Segments:         stats.Segments,
+			TotalBytes:       stats.TotalBytes,
+			LiveBytes:        stats.LiveBytes,
+			DeadBytes:        stats.DeadBytes,
+			Keys:             stats.Keys,
+			ActiveBytes:      stats.ActiveBytes,
+			ActiveFill:       stats.ActiveFill,
+			Merges:           stats.Merges,
+			MergeSeconds:     stats.MergeDuration.Seconds(),
+			LastMergeSeconds: stats.LastMergeDuration.Seconds(),
+			ValueBytes:       stats.ValueBytes,
+			StoredValueBytes: stats.StoredValueBytes,
+			CompressionRatio: stats.CompressionRatio(),
+			CacheHits:        stats.CacheHits,
+			CacheMisses:      stats.CacheMisses,
+			CacheBytes:       stats.CacheBytes,
+			CompactionErrors: stats.CompactionErrors,
+		}
+		if stats.CompactionError != nil {
+			res.CompactionError = stats.CompactionError.Error()
+		}
+		rw.WriteHeader(http.StatusOK)
+
+		err := json.NewEncoder(rw).Encode(&res)
+
+		if err != nil {
+			log.Printf("%s", err)
+		}
+	}).Methods("GET")
+
+	router.HandleFunc(adminPrefix+"/backup", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", octetStream)
+		rw.Header().Set("content-disposition", `attachment; filename="backup.db"`)
+		rw.WriteHeader(http.StatusOK)
+
+		// The status is sent already, so a failed backup can only be told by
+		// the missing trailer.
+		if err := db.Backup(rw); err != nil {
+			log.Printf("Backup: %s", err)
+		}
+	}).Methods("GET")
+
+	router.HandleFunc(adminPrefix+"/restore", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+
+		if t := requestType(r); t != "" && t != octetStream {
+			rw.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		err := db.Restore(r.Body)
+		if err == datastore.ErrBadBackup {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Restore: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}).Methods("POST")
+
 	router.HandleFunc("/db/{key}", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "application/json")
 
@@ -57,31 +244,71 @@ func main() {
 
 		var body RequestPayload
 		err := json.NewDecoder(r.Body).Decode(&body)
-		if err != nil {
+		if err != nil || body.TTL < 0 {
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		writeValue(db, rw, r, key, body.Value, time.Duration(body.TTL)*time.Second)
+	}).Methods("POST")
 
-		err = db.Put(key, body.Value)
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
+	router.HandleFunc("/db/{key}", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+
+		vars := mux.Vars(r)
+		key := vars["key"]
+
+		var body RequestPayload
+		switch requestType(r) {
+		case "", "application/json":
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if err != nil || body.TTL < 0 {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		case octetStream:
+			if writePrecondition(r) == nil {
+				// Raw values are streamed to the database unless the
+				// precondition has to be checked against them.
+				if err := db.PutReader(key, r.Body); err != nil {
+					rw.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				rw.WriteHeader(http.StatusOK)
+				return
+			}
+			value, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body.Value = string(value)
+		default:
+			rw.WriteHeader(http.StatusUnsupportedMediaType)
 			return
 		}
-		rw.WriteHeader(http.StatusOK)
-	}).Methods("POST")
+
+		writeValue(db, rw, r, key, body.Value, time.Duration(body.TTL)*time.Second)
+	}).Methods("PUT")
 
 	router.HandleFunc("/db/{key}", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "application/json")
 
 		vars := mux.Vars(r)
 		key := vars["key"]
-		value, err := db.Get(key)
+
+		if acceptsOctetStream(r) {
+			writeRawValue(db, rw, key)
+			return
+		}
+
+		value, version, err := db.GetVersion(key)
 
 		if err != nil {
 			rw.WriteHeader(http.StatusNotFound)
 			return
 		}
 
+		rw.Header().Set("ETag", formatETag(version))
 		rw.WriteHeader(http.StatusOK)
 
 		res := Response{key, value}
@@ -92,6 +319,44 @@ func main() {
 		}
 	}).Methods("GET")
 
+	router.HandleFunc("/db", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+
+		query := r.URL.Query()
+		limit := defaultListLimit
+		if limitParam := query.Get("limit"); limitParam != "" {
+			n, err := strconv.Atoi(limitParam)
+			if err != nil || n <= 0 || n > maxListLimit {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		res := ListResponse{Items: []Response{}}
+		cursor, err := db.Iterate(query.Get("prefix"), query.Get("cursor"), func(key, value string) bool {
+			res.Items = append(res.Items, Response{key, value})
+			return len(res.Items) < limit
+		})
+		if err == datastore.ErrBadCursor {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res.Cursor = cursor
+
+		rw.WriteHeader(http.StatusOK)
+
+		err1 := json.NewEncoder(rw).Encode(&res)
+
+		if err1 != nil {
+			log.Printf("%s", err1)
+		}
+	}).Methods("GET")
+
 	h := new(http.ServeMux)
 	h.Handle("/", router)
 
@@ -99,3 +364,61 @@ func main() {
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
+
+// writeValue stores value under key, honouring the preconditions of the
+// request, and answers it.
+func writeValue(db *datastore.Db, rw http.ResponseWriter, r *http.Request, key, value string, ttl time.Duration) {
+	var err error
+	if cond := writePrecondition(r); cond != nil {
+		var version uint64
+		if ttl > 0 {
+			version, err = db.PutIfWithTTL(key, value, ttl, cond)
+		} else {
+			version, err = db.PutIf(key, value, cond)
+		}
+		if err == datastore.ErrConflict {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("ETag", formatETag(version))
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if ttl > 0 {
+		err = db.PutWithTTL(key, value, ttl)
+	} else {
+		err = db.Put(key, value)
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// writeRawValue streams the value of key as the response body.
+func writeRawValue(db *datastore.Db, rw http.ResponseWriter, key string) {
+	vr, err := db.GetReader(key)
+	if err == datastore.ErrNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer vr.Close()
+
+	rw.Header().Set("content-type", octetStream)
+	rw.Header().Set("content-length", strconv.FormatInt(vr.Size(), 10))
+	rw.Header().Set("ETag", formatETag(vr.Version()))
+	rw.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(rw, vr); err != nil {
+		log.Printf("%s", err)
+	}
+}
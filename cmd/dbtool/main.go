@@ -0,0 +1,280 @@
+// Command dbtool inspects and fixes a datastore directory while no server has
+// it open.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Kolbasen/design-practice-2/cmd/datastore"
+)
+
+const MB = 1024 * 1024
+
+const usage = `usage: dbtool <command> [flags] <dir>
+
+commands:
+  list     list the live segments
+  dump     print every record, deleted and shadowed ones included, as JSON lines
+  verify   check record checksums, hint files and Bloom filters
+  compact  merge all segments into one
+  repair   cut off torn or corrupted segment tails and rebuild hint files
+`
+
+var commands = map[string]func(args []string) error{
+	"list":    list,
+	"dump":    dump,
+	"verify":  verify,
+	"compact": compact,
+	"repair":  repair,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := commands[os.Args[1]](os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "dbtool %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// parse parses the flags of a command and returns the directory it is given.
+func parse(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("expected a database directory")
+	}
+	return fs.Arg(0), nil
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	names, err := datastore.ListSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SEGMENT\tBYTES\tRECORDS\tDELETES\tTORN\tHINT\tBLOOM")
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		var records, deletes int
+		tail, err := datastore.ScanSegment(path, nil, func(r datastore.Record) error {
+			records++
+			if r.Kind == "delete" {
+				deletes++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", name, tail.Offset+tail.Dropped, records, deletes,
+			tail.Dropped, exists(path+".hint"), exists(path+".bloom"))
+	}
+	return w.Flush()
+}
+
+func exists(path string) string {
+	if _, err := os.Stat(path); err != nil {
+		return "no"
+	}
+	return "yes"
+}
+
+// dumpRecord is a line of the dump. Keys and values that are not valid UTF-8
+// are given in base64 instead.
+type dumpRecord struct {
+	Segment     string `json:"segment"`
+	Offset      int64  `json:"offset"`
+	Size        int64  `json:"size"`
+	Kind        string `json:"kind"`
+	Seq         uint64 `json:"seq,omitempty"`
+	Expires     string `json:"expires,omitempty"`
+	Key         string `json:"key,omitempty"`
+	KeyBase64   string `json:"key_base64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	Compressed  bool   `json:"compressed,omitempty"`
+	Encrypted   bool   `json:"encrypted,omitempty"`
+	// Live tells whether the record holds the current value of its key.
+	Live bool `json:"live"`
+}
+
+type recordID struct {
+	segment int
+	offset  int64
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "file with encryption keys, overrides "+datastore.KeysEnv)
+	only := fs.String("segment", "", "dump a single segment")
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	keyring, err := datastore.LoadKeyring(*keyFile)
+	if err != nil {
+		return err
+	}
+	names, err := datastore.ListSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	// The newest record of every key is found first, so that the records it
+	// shadows can be told apart.
+	newest := map[string]recordID{}
+	for i, name := range names {
+		_, err := datastore.ScanSegment(filepath.Join(dir, name), nil, func(r datastore.Record) error {
+			if r.Kind != "batch" {
+				newest[r.Key] = recordID{i, r.Offset}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UnixNano()
+	out := json.NewEncoder(os.Stdout)
+	for i, name := range names {
+		if *only != "" && name != *only {
+			continue
+		}
+		tail, err := datastore.ScanSegment(filepath.Join(dir, name), keyring, func(r datastore.Record) error {
+			line := dumpRecord{
+				Segment:    name,
+				Offset:     r.Offset,
+				Size:       r.Size,
+				Kind:       r.Kind,
+				Seq:        r.Seq,
+				Compressed: r.Compressed,
+				Encrypted:  r.Encrypted,
+				Live: newest[r.Key] == recordID{i, r.Offset} && (r.Kind == "put" || r.Kind == "blob") &&
+					(r.Expires == 0 || r.Expires > now),
+			}
+			if r.Expires != 0 {
+				line.Expires = time.Unix(0, r.Expires).UTC().Format(time.RFC3339Nano)
+			}
+			if r.Kind != "batch" {
+				line.Key, line.KeyBase64 = text(r.Key)
+			}
+			if !r.Encrypted {
+				line.Value, line.ValueBase64 = text(r.Value)
+			}
+			return out.Encode(&line)
+		})
+		if err != nil {
+			return err
+		}
+		if tail.Dropped > 0 {
+			fmt.Fprintf(os.Stderr, "segment %s: %d bytes of torn or corrupted records at offset %d\n", name, tail.Dropped, tail.Offset)
+		}
+	}
+	return nil
+}
+
+// text returns s as it is when it is valid UTF-8, and base64 encoded
+// otherwise.
+func text(s string) (string, string) {
+	if utf8.ValidString(s) {
+		return s, ""
+	}
+	return "", base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	problems, err := datastore.Verify(dir)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func compact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	segmentSize := fs.Int("s", 10*MB, "segment size")
+	compress := fs.Bool("compress", false, "store values compressed")
+	keyFile := fs.String("key-file", "", "file with encryption keys, overrides "+datastore.KeysEnv)
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var opts []datastore.Option
+	if *compress {
+		opts = append(opts, datastore.WithCompression())
+	}
+	keyring, err := datastore.LoadKeyring(*keyFile)
+	if err != nil {
+		return err
+	}
+	if keyring != nil {
+		opts = append(opts, datastore.WithEncryption(keyring))
+	}
+	db, err := datastore.NewDb(dir, int64(*segmentSize), opts...)
+	if err != nil {
+		return err
+	}
+	before := db.Stats()
+	err = db.Compact()
+	after := db.Stats()
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// Opening the database starts an empty active segment, which is left
+	// out of the counts.
+	fmt.Printf("%d segments of %d bytes merged into %d of %d bytes, plus an empty segment for new writes\n",
+		before.Segments-1, before.TotalBytes-before.ActiveBytes, after.Segments-1, after.TotalBytes-after.ActiveBytes)
+	return nil
+}
+
+func repair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	dir, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	tails, err := datastore.Repair(dir)
+	for _, tail := range tails {
+		fmt.Printf("%s: cut off %d bytes at offset %d\n", tail.Path, tail.Dropped, tail.Offset)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("segments repaired: %d\n", len(tails))
+	return nil
+}